@@ -3,9 +3,13 @@ package ast
 import (
 	"fmt"
 	"io"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type nodeType int
@@ -18,20 +22,36 @@ const (
 	name
 	slice
 	function
+	unary
+	lbracket
+	rbracket
+	colon
+	index
+	none
+	comma
+	assign
+	semicolon
+	let
+	paren
 )
 
 type AST struct {
-	token Token
-	left  *AST
-	right *AST
+	token  Token
+	left   *AST
+	right  *AST
+	args   []*AST
+	parens *Token // the outermost parentheses around the node, if any
 }
 
 type Token struct {
-	typ     nodeType
-	val     string
-	pos     int
-	varName string
-	varIdx  int
+	typ    nodeType
+	val    string
+	pos    int // byte offset of the token in the source
+	end    int // byte offset just after the token
+	arity  int
+	quoted bool     // a name written as a quoted identifier, e.g. "cpu load"
+	def    *FuncDef // the called function, for functions defined with def
+	fn     *Func    // the called function, for functions implemented in Go
 }
 
 var (
@@ -39,80 +59,475 @@ var (
 )
 
 func init() {
-	g_name_pattern = regexp.MustCompile(`\w+(\[\d+\])?`)
+	g_name_pattern = regexp.MustCompile(`^\w+(\.\w+)*$`)
 }
 
+// group tracks a parenthesis or bracket that is still open while parsing.
+type group struct {
+	typ   nodeType // lparen or lbracket
+	call  bool     // the parenthesis holds the arguments of a function call
+	count int      // ',' separators seen in a call, ':' in a bracket
+}
+
+// Mode is a set of flags controlling optional parser behaviour.
+type Mode uint
+
+const (
+	// AllErrors makes the parser recover from syntax errors and report all
+	// of them, in source order, as an ErrorList.
+	AllErrors Mode = 1 << iota
+)
+
+// parser holds the state of the shunting-yard algorithm run by ParseExpr.
+type parser struct {
+	source    string
+	mode      Mode
+	tokens    []Token
+	output    []Token
+	operators []Token
+	groups    []group
+	errors    ErrorList
+	defs      map[string]*FuncDef // functions defined by the program so far
+	funcs     map[string]*Func    // Go functions given to ParseExprFuncs
+}
+
+// ParseExpr parses expression into an AST. It stops at the first error,
+// which is returned as a *ParseError. Lexical errors, such as an unexpected
+// character, are found before parsing and reported ahead of the syntax
+// errors preceding them. ParseExpr accepts any string and never panics.
 func ParseExpr(expression string) (*AST, error) {
-	var tokens = tokenize(expression)
-	var outputStack []Token
-	var operatorStack []Token
-	for _, token := range tokens {
+	return ParseExprMode(expression, 0)
+}
+
+// ParseExprMode parses expression like ParseExpr. With the AllErrors mode
+// set, the parser keeps going after an error and the returned error is an
+// ErrorList holding every error found, sorted by position.
+func ParseExprMode(expression string, mode Mode) (*AST, error) {
+	return ParseExprFuncs(expression, mode)
+}
+
+// ParseExprFuncs parses expression like ParseExprMode, where the program can
+// also call funcs, which hide the functions of the same name registered with
+// RegisterFunc. It returns an error without parsing if one of funcs is not
+// valid.
+func ParseExprFuncs(expression string, mode Mode, funcs ...*Func) (*AST, error) {
+	p := &parser{source: expression, mode: mode, defs: make(map[string]*FuncDef), funcs: make(map[string]*Func)}
+	for _, fn := range funcs {
+		if err := validateFunc(fn); err != nil {
+			return nil, err
+		}
+		p.funcs[fn.Name] = fn
+	}
+	tokens, errs := tokenize(expression, mode)
+	p.errors = errs
+	node := p.parseProgram(tokens)
+	if len(p.errors) == 0 {
+		return node, nil
+	}
+	if mode&AllErrors == 0 {
+		first := p.errors[:1]
+		first.locate()
+		return nil, first[0]
+	}
+	p.errors.Sort()
+	p.errors.locate()
+	return nil, p.errors
+}
+
+// parseProgram parses a sequence of assignments and function definitions
+// separated by ';' and followed by the result expression, e.g.
+// lo = nanmin(X); X - lo. Each assignment becomes a let node holding the
+// bound value on the left and the rest of the program, where the name is
+// visible, on the right. Functions are visible in the statements following
+// their definition; a function is defined once, and not after a statement
+// calls a function of the same name.
+func (p *parser) parseProgram(tokens []Token) *AST {
+	var statements [][]Token
+	var separators []Token
+	start := 0
+	for i, token := range tokens {
+		if token.typ == semicolon {
+			statements = append(statements, tokens[start:i])
+			separators = append(separators, token)
+			start = i + 1
+		}
+	}
+	statements = append(statements, tokens[start:])
+	if len(statements) == 1 && (len(tokens) < 2 || tokens[1].typ != assign) && !isDefStatement(tokens) {
+		return p.parseExpr(tokens)
+	}
+	assigned := make(map[string]bool)
+	for _, statement := range statements {
+		if len(statement) >= 2 && statement[1].typ == assign {
+			assigned[statement[0].val] = true
+		}
+	}
+	for _, statement := range statements {
+		if !isDefStatement(statement) {
+			shadowConstants(statement, assigned)
+		}
+	}
+	defined := make(map[string]bool)
+	// names called by the statements so far: a function defined afterwards
+	// under one of them would not be the one these calls use
+	called := make(map[string]bool)
+	var targets []Token
+	var values []*AST
+	for k, statement := range statements {
+		if p.stopped() {
+			return nil
+		}
+		if isDefStatement(statement) {
+			if k == len(statements)-1 {
+				p.fail(statement[1], fmt.Sprintf("missing result expression after the definition of '%s'", statement[1].val), "';'")
+			}
+			switch def := p.parseDef(statement, defined); {
+			case def == nil:
+			case p.defs[def.Name] != nil:
+				p.fail(statement[1], fmt.Sprintf("function '%s' is already defined", def.Name))
+			case called[def.Name]:
+				p.fail(statement[1], fmt.Sprintf("function '%s' is defined after it is called", def.Name))
+			default:
+				p.defs[def.Name] = def
+			}
+			addCalls(called, statement[2:])
+			continue
+		}
+		addCalls(called, statement)
+		var target Token
+		if len(statement) >= 2 && statement[1].typ == assign {
+			target = statement[0]
+			if !isPlainName(target) {
+				p.fail(target, fmt.Sprintf("cannot assign to '%s'", target.val), "name")
+			} else if k == len(statements)-1 {
+				p.fail(target, fmt.Sprintf("missing result expression after the assignment to '%s'", target.val), "';'")
+			}
+			if len(statement) == 2 {
+				p.fail(statement[1], "missing expression after '='", "expression")
+				defined[target.val] = true
+				continue
+			}
+			statement = statement[2:]
+		} else if len(statement) == 0 {
+			if k == len(statements)-1 {
+				p.fail(separators[k-1], "missing result expression after ';'", "expression")
+			} else {
+				p.fail(separators[k], "empty statement before ';'", "expression")
+			}
+			continue
+		} else if k < len(statements)-1 {
+			p.fail(statement[0], "only the last statement can be an expression, others must be assignments", "name '='")
+		}
+		for _, token := range statement {
+			if token.typ == name && !token.quoted && assigned[token.val] && !defined[token.val] {
+				p.fail(token, fmt.Sprintf("'%s' is used before it is defined", token.val))
+			}
+		}
+		value := p.parseExpr(statement)
+		if target.typ == name {
+			defined[target.val] = true
+		}
+		targets = append(targets, target)
+		values = append(values, value)
+	}
+	if len(p.errors) > 0 {
+		return nil
+	}
+	node := values[len(values)-1]
+	for k := len(values) - 2; k >= 0; k-- {
+		node = &AST{token: Token{typ: let, val: targets[k].val, pos: targets[k].pos, end: targets[k].end}, left: values[k], right: node}
+	}
+	return node
+}
+
+// addCalls adds to called the names of the functions tokens call.
+func addCalls(called map[string]bool, tokens []Token) {
+	for i, token := range tokens {
+		if (token.typ == name || token.typ == function) && !token.quoted && i+1 < len(tokens) && tokens[i+1].typ == lparen {
+			called[token.val] = true
+		}
+	}
+}
+
+// isPlainName reports whether token is a name that can be bound by an
+// assignment or a function parameter: neither quoted nor dotted.
+func isPlainName(token Token) bool {
+	return token.typ == name && !token.quoted && !strings.Contains(token.val, ".")
+}
+
+// isDefStatement reports whether statement defines a function.
+func isDefStatement(statement []Token) bool {
+	if len(statement) < 2 || !isDefKeyword(statement[0]) {
+		return false
+	}
+	switch statement[1].typ {
+	case name, function:
+		return true
+	case number:
+		return isConstant(statement[1].val)
+	}
+	return false
+}
+
+// parseExpr parses the tokens of a single expression, returning nil when
+// there are errors.
+func (p *parser) parseExpr(tokens []Token) *AST {
+	p.tokens = tokens
+	p.output, p.operators, p.groups = nil, nil, nil
+	p.parse()
+	if len(p.errors) > 0 {
+		return nil
+	}
+	node := p.build()
+	p.checkTypes(node)
+	if len(p.errors) > 0 {
+		return nil
+	}
+	return node
+}
+
+// fail records an error at token, listing the kinds of tokens that were
+// expected there when they are known.
+func (p *parser) fail(token Token, message string, expected ...string) {
+	p.errors = append(p.errors, newParseError(p.source, token.pos, token.val, message, expected...))
+}
+
+// stopped reports whether parsing must end: after the first error, unless
+// the parser recovers from errors.
+func (p *parser) stopped() bool {
+	return len(p.errors) > 0 && p.mode&AllErrors == 0
+}
+
+func (p *parser) emit(token Token) {
+	p.output = append(p.output, token)
+}
+
+func (p *parser) push(token Token) {
+	p.operators = append(p.operators, token)
+}
+
+func (p *parser) pop() Token {
+	top := p.operators[len(p.operators)-1]
+	p.operators = p.operators[:len(p.operators)-1]
+	return top
+}
+
+// popUntil moves operators to the output until the innermost '(' or '['.
+func (p *parser) popUntil() {
+	for p.operators[len(p.operators)-1].typ != lparen && p.operators[len(p.operators)-1].typ != lbracket {
+		p.emit(p.pop())
+	}
+}
+
+// parse converts the tokens to postfix order in p.output. When an error is
+// recovered from, the offending token is skipped or given the closest valid
+// meaning, so that the following errors are still reported; the output is
+// not used then.
+func (p *parser) parse() {
+	for i := 0; i < len(p.tokens) && !p.stopped(); i++ {
+		token := p.tokens[i]
+		if token.typ == operator && isUnary(p.tokens, i) {
+			token.typ = unary
+		}
+		var prev nodeType = none
+		if i > 0 {
+			prev = p.tokens[i-1].typ
+		}
+		operandNext := i == 0 || expectsOperand(p.tokens[i-1])
+		switch token.typ {
+		case number, name, function, unary, lparen:
+			if !operandNext && !(token.typ == lparen && prev == function) {
+				p.fail(token, "missing operator", "operator")
+			}
+		case operator:
+			if operandNext {
+				p.fail(token, "missing operand", "expression")
+			}
+		case comma, rparen, colon, rbracket:
+			if prev == operator {
+				p.fail(token, "missing operand", "expression")
+			}
+		case assign:
+			p.fail(token, "unexpected '=': assignments must start a statement", "'=='")
+			continue
+		case semicolon:
+			p.fail(token, "unexpected ';'")
+			continue
+		}
 		switch token.typ {
 		case number:
-			outputStack = append(outputStack, token)
+			p.emit(token)
 		case name:
-			if strings.Contains(token.val, "[") {
-				i := strings.Index(token.val, "[")
-				j := strings.Index(token.val, "]")
-				if j == -1 {
-					return nil, &ParseError{at: token.pos, message: "Unbalanced expression: missing ']'"}
-				}
-				if idx, err := strconv.Atoi(token.val[i+1 : j]); err == nil {
-					outputStack = append(outputStack, Token{typ: slice, varName: token.val[:i], varIdx: idx})
+			if i+1 < len(p.tokens) && p.tokens[i+1].typ == lparen {
+				if def, fn := p.resolveFunc(token.val); (def != nil || fn != nil) && !token.quoted {
+					p.tokens[i].typ = function
+					token.typ, token.def, token.fn = function, def, fn
+					p.push(token)
 					continue
 				}
-				errorString := fmt.Sprintf("Invalid slice index '%s'", token.val[i+1:j])
-				return nil, &ParseError{at: token.pos, message: errorString}
-			} else {
-				outputStack = append(outputStack, token)
+				p.fail(token, fmt.Sprintf("unknown function '%s'", token.val))
+				// parse the arguments as a call anyway
+				p.tokens[i].typ = function
+				token.typ = function
+				p.push(token)
+				continue
 			}
+			p.emit(token)
+		case unary:
+			p.push(token)
 		case operator:
-			for len(operatorStack) > 0 && precedence(operatorStack[len(operatorStack)-1].val) >= precedence(token.val) {
-				outputStack = append(outputStack, operatorStack[len(operatorStack)-1])
-				operatorStack = operatorStack[:len(operatorStack)-1]
+			for len(p.operators) > 0 && popsBefore(p.operators[len(p.operators)-1], token) {
+				p.emit(p.pop())
 			}
-			operatorStack = append(operatorStack, token)
+			p.push(token)
 		case function:
-			operatorStack = append(operatorStack, token)
+			if i+1 == len(p.tokens) || p.tokens[i+1].typ != lparen {
+				p.fail(token, fmt.Sprintf("missing '(' after function '%s'", token.val), "'('")
+				// read it as a value
+				p.tokens[i].typ = name
+				p.emit(token)
+				continue
+			}
+			if token.def, token.fn = p.resolveFunc(token.val); token.def == nil && token.fn == nil {
+				p.fail(token, fmt.Sprintf("unknown function '%s'", token.val))
+			}
+			p.push(token)
 		case lparen:
-			operatorStack = append(operatorStack, token)
+			p.push(token)
+			p.groups = append(p.groups, group{typ: lparen, call: prev == function})
+		case comma:
+			if len(p.groups) == 0 || !p.groups[len(p.groups)-1].call {
+				p.fail(token, "unexpected ',' outside of function arguments")
+				continue
+			}
+			if prev == lparen || prev == comma {
+				p.fail(token, "missing function argument", "expression")
+			}
+			p.popUntil()
+			p.groups[len(p.groups)-1].count++
 		case rparen:
-			found := false
-			for len(operatorStack) > 0 {
-				if operatorStack[len(operatorStack)-1].typ == lparen {
-					found = true
-					operatorStack = operatorStack[:len(operatorStack)-1]
-					break
+			if len(p.groups) == 0 || p.groups[len(p.groups)-1].typ != lparen {
+				p.fail(token, "unbalanced parenthesis")
+				continue
+			}
+			g := p.groups[len(p.groups)-1]
+			p.groups = p.groups[:len(p.groups)-1]
+			if prev == comma {
+				p.fail(token, "missing function argument", "expression")
+			} else if prev == lparen && !g.call {
+				p.fail(token, "missing expression in parentheses", "expression")
+			}
+			p.popUntil()
+			open := p.pop()
+			if !g.call {
+				p.emit(Token{typ: paren, pos: open.pos, end: token.end})
+			}
+			if g.call {
+				fn := p.pop()
+				fn.end = token.end
+				fn.arity = g.count + 1
+				if prev == lparen {
+					fn.arity = 0
+				}
+				if fn.def != nil || fn.fn != nil {
+					if err := checkArity(p.source, fn); err != nil {
+						p.errors = append(p.errors, err)
+					}
+				}
+				p.emit(fn)
+			}
+		case lbracket:
+			if i == 0 || !isOperandEnd(p.tokens[i-1]) {
+				p.fail(token, "unexpected '[': only values can be indexed")
+				// index a placeholder so that the matching ']' still closes it
+				p.emit(Token{typ: none, pos: token.pos})
+			}
+			p.push(token)
+			p.groups = append(p.groups, group{typ: lbracket})
+		case colon, rbracket:
+			if len(p.groups) == 0 {
+				p.fail(token, fmt.Sprintf("unexpected '%s' outside of brackets", token.val))
+				continue
+			}
+			if p.groups[len(p.groups)-1].typ != lbracket {
+				p.fail(token, "unbalanced parenthesis")
+				continue
+			}
+			p.popUntil()
+			if token.typ == colon {
+				if p.groups[len(p.groups)-1].count == 2 {
+					p.fail(token, "too many ':' in slice", "']'")
+					continue
+				}
+				if prev == lbracket || prev == colon {
+					p.emit(Token{typ: none, pos: token.pos})
 				}
-				outputStack = append(outputStack, operatorStack[len(operatorStack)-1])
-				operatorStack = operatorStack[:len(operatorStack)-1]
+				p.groups[len(p.groups)-1].count++
+				continue
 			}
-			if len(operatorStack) > 0 {
-				if operatorStack[len(operatorStack)-1].typ == function {
-					outputStack = append(outputStack, operatorStack[len(operatorStack)-1])
-					operatorStack = operatorStack[:len(operatorStack)-1]
+			p.pop()
+			n := p.groups[len(p.groups)-1].count
+			p.groups = p.groups[:len(p.groups)-1]
+			if n == 0 {
+				if prev == lbracket {
+					p.fail(token, "missing index", "expression", "':'")
 				}
+				p.emit(Token{typ: index, val: "[]", pos: token.pos, end: token.end})
+				continue
 			}
-			if !found {
-				return nil, &ParseError{at: token.pos, message: "unbalanced parenthesis"}
+			if prev == colon {
+				p.emit(Token{typ: none, pos: token.pos})
 			}
+			p.emit(Token{typ: slice, val: strings.Repeat(":", n), pos: token.pos, end: token.end})
 		}
 	}
-	for len(operatorStack) > 0 {
-		if operatorStack[len(operatorStack)-1].typ == lparen || operatorStack[len(operatorStack)-1].typ == rparen {
-			return nil, &ParseError{at: tokens[len(tokens)-1].pos, message: "unbalanced parenthesis"}
+	if len(p.tokens) == 0 && len(p.errors) == 0 {
+		p.fail(Token{typ: none}, "empty expression", "expression")
+	} else if len(p.tokens) > 0 && p.tokens[len(p.tokens)-1].typ == operator && !p.stopped() {
+		p.fail(p.tokens[len(p.tokens)-1], "missing operand", "expression")
+	}
+	for len(p.operators) > 0 && !p.stopped() {
+		switch p.operators[len(p.operators)-1].typ {
+		case lparen:
+			p.fail(p.tokens[len(p.tokens)-1], "unbalanced parenthesis", "')'")
+			return
+		case lbracket:
+			p.fail(p.tokens[len(p.tokens)-1], "Unbalanced expression: missing ']'", "']'")
+			return
 		}
-		outputStack = append(outputStack, operatorStack[len(operatorStack)-1])
-		operatorStack = operatorStack[:len(operatorStack)-1]
+		p.emit(p.pop())
 	}
+}
+
+// build turns the postfix output of a successful parse into an AST.
+func (p *parser) build() *AST {
 	var astStack []*AST
-	for _, token := range outputStack {
-		if token.typ == number || token.typ == name || token.typ == slice {
+	for _, token := range p.output {
+		if token.typ == number || token.typ == name {
 			astStack = append(astStack, &AST{token: token, left: nil, right: nil})
+		} else if token.typ == paren {
+			parens := token
+			astStack[len(astStack)-1].parens = &parens
+		} else if token.typ == none {
+			astStack = append(astStack, nil)
 		} else if token.typ == function {
+			args := make([]*AST, token.arity)
+			copy(args, astStack[len(astStack)-token.arity:])
+			astStack = astStack[:len(astStack)-token.arity]
+			astStack = append(astStack, &AST{token: token, args: args})
+		} else if token.typ == unary {
 			right := astStack[len(astStack)-1]
 			astStack = astStack[:len(astStack)-1]
 			astStack = append(astStack, &AST{token: token, left: nil, right: right})
+		} else if token.typ == slice {
+			// start:stop or start:stop:step, with nil for omitted bounds
+			bounds := make([]*AST, 3)
+			n := len(token.val) + 1
+			copy(bounds, astStack[len(astStack)-n:])
+			astStack = astStack[:len(astStack)-n]
+			left := astStack[len(astStack)-1]
+			astStack = astStack[:len(astStack)-1]
+			astStack = append(astStack, &AST{token: token, left: left, args: bounds})
 		} else {
 			right := astStack[len(astStack)-1]
 			astStack = astStack[:len(astStack)-1]
@@ -121,106 +536,163 @@ func ParseExpr(expression string) (*AST, error) {
 			astStack = append(astStack, &AST{token: token, left: left, right: right})
 		}
 	}
-	return astStack[0], nil
+	return astStack[0]
+}
+
+// isOperandEnd reports whether token ends an operand, so that a following
+// '[' indexes the value computed so far.
+func isOperandEnd(token Token) bool {
+	return token.typ == number || token.typ == name || token.typ == rparen || token.typ == rbracket
 }
 
-func tokenize(expression string) []Token {
+// tokenize splits expression into tokens. It stops at the first invalid
+// text unless the AllErrors mode is set, and reports it in the returned
+// ErrorList. Invalid text is kept as a placeholder token so that the parser
+// does not report errors caused by its absence: invalid number literals are
+// number tokens, and other invalid text is read as an operator after an
+// operand and as an operand elsewhere. Consecutive invalid text shares one
+// placeholder.
+func tokenize(expression string, mode Mode) ([]Token, ErrorList) {
 	var tokens []Token
+	var errs ErrorList
 	var buf strings.Builder
 	var pos int
+	var skip int
+	placeholder := -1 // index in tokens of the last placeholder
+	invalid := func(pos int, text string, message string) {
+		errs = append(errs, newParseError(expression, pos, text, message))
+		if placeholder >= 0 && placeholder == len(tokens)-1 {
+			tokens[placeholder].end = pos + len(text)
+			tokens[placeholder].val = expression[tokens[placeholder].pos:tokens[placeholder].end]
+			return
+		}
+		token := Token{typ: number, val: text, pos: pos, end: pos + len(text)}
+		if len(tokens) > 0 && isOperandEnd(tokens[len(tokens)-1]) {
+			token.typ = operator
+		}
+		placeholder = len(tokens)
+		tokens = append(tokens, token)
+	}
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		word := buf.String()
+		buf.Reset()
+		if isConstant(word) {
+			tokens = append(tokens, Token{typ: number, val: word, pos: pos, end: pos + len(word)})
+		} else if isBuiltin(word) {
+			tokens = append(tokens, Token{typ: function, val: functionName(word), pos: pos, end: pos + len(word)})
+		} else if isKeyword(word) {
+			tokens = append(tokens, Token{typ: operator, val: word, pos: pos, end: pos + len(word)})
+		} else if isName(word) {
+			tokens = append(tokens, Token{typ: name, val: word, pos: pos, end: pos + len(word)})
+		} else {
+			invalid(pos, word, fmt.Sprintf("found unexpected token '%s'", word))
+		}
+	}
 	for i, char := range expression {
-		if char == ' ' {
+		if len(errs) > 0 && mode&AllErrors == 0 {
+			return tokens, errs
+		}
+		if skip > 0 {
+			skip--
 			continue
-		} else if isOperator(string(char)) {
-			if buf.Len() > 0 {
-				if isNumber(buf.String()) {
-					tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-				} else if isFunction(buf.String()) {
-					tokens = append(tokens, Token{typ: function, val: buf.String(), pos: pos})
-				} else if isName(buf.String()) {
-					tokens = append(tokens, Token{typ: name, val: buf.String(), pos: pos})
-				} else {
-					_, err := strconv.ParseFloat(buf.String(), 64)
-					if err == nil {
-						tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-					} else {
-						return nil
-					}
-				}
-				buf.Reset()
+		}
+		if unicode.IsSpace(char) {
+			flush()
+		} else if char == '#' || strings.HasPrefix(expression[i:], "//") {
+			// line comment, up to the end of the line
+			flush()
+			comment := expression[i:]
+			if end := strings.IndexByte(comment, '\n'); end >= 0 {
+				comment = comment[:end]
 			}
-			tokens = append(tokens, Token{typ: operator, val: string(char), pos: i})
-		} else if isNumber(string(char)) || string(char) == "." {
-			buf.WriteRune(char)
-			if pos == 0 {
-				pos = i
+			skip = utf8.RuneCountInString(comment) - 1
+		} else if op := operatorAt(expression, i); op != "" {
+			flush()
+			tokens = append(tokens, Token{typ: operator, val: op, pos: i, end: i + len(op)})
+			skip = len(op) - 1
+		} else if buf.Len() == 0 && (isDigit(char) || char == '.') {
+			literal := expression[i : i+scanNumber(expression[i:])]
+			if !isNumber(literal) {
+				errs = append(errs, newParseError(expression, i, literal, fmt.Sprintf("invalid number literal '%s'", literal), "number"))
 			}
-		} else if isAlpha(char) {
-			buf.WriteRune(char)
-			if pos == 0 {
+			tokens = append(tokens, Token{typ: number, val: literal, pos: i, end: i + len(literal)})
+			skip = len(literal) - 1
+		} else if char == '[' {
+			flush()
+			tokens = append(tokens, Token{typ: lbracket, val: string(char), pos: i, end: i + 1})
+		} else if char == ']' {
+			flush()
+			tokens = append(tokens, Token{typ: rbracket, val: string(char), pos: i, end: i + 1})
+		} else if char == ',' {
+			flush()
+			tokens = append(tokens, Token{typ: comma, val: string(char), pos: i, end: i + 1})
+		} else if char == '=' {
+			flush()
+			tokens = append(tokens, Token{typ: assign, val: string(char), pos: i, end: i + 1})
+		} else if char == ';' {
+			flush()
+			tokens = append(tokens, Token{typ: semicolon, val: string(char), pos: i, end: i + 1})
+		} else if char == ':' {
+			flush()
+			tokens = append(tokens, Token{typ: colon, val: string(char), pos: i, end: i + 1})
+		} else if char == '"' {
+			flush()
+			literal, err := scanQuotedName(expression[i:])
+			if err != nil {
+				invalid(i, literal, err.Error())
+			} else {
+				val, _ := strconv.Unquote(literal)
+				tokens = append(tokens, Token{typ: name, val: val, pos: i, end: i + len(literal), quoted: true})
+			}
+			skip = utf8.RuneCountInString(literal) - 1
+		} else if isDigit(char) || char == '.' || isAlpha(char) {
+			if buf.Len() == 0 {
 				pos = i
 			}
+			buf.WriteRune(char)
 		} else if char == '(' {
-			if buf.Len() > 0 {
-				if isNumber(buf.String()) {
-					tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-				} else if isFunction(buf.String()) {
-					tokens = append(tokens, Token{typ: function, val: buf.String(), pos: pos})
-				} else if isName(buf.String()) {
-					tokens = append(tokens, Token{typ: name, val: buf.String(), pos: pos})
-				} else {
-					_, err := strconv.ParseFloat(buf.String(), 64)
-					if err == nil {
-						tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-					} else {
-						errorString := fmt.Sprintf("found unexpected char '%s' at index %d", string(char), i)
-						panic(errorString)
-					}
-				}
-				buf.Reset()
-			}
-			tokens = append(tokens, Token{typ: lparen, val: string(char), pos: i})
+			flush()
+			tokens = append(tokens, Token{typ: lparen, val: string(char), pos: i, end: i + 1})
 		} else if char == ')' {
-			if buf.Len() > 0 {
-				if isNumber(buf.String()) {
-					tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-				} else if isName(buf.String()) {
-					tokens = append(tokens, Token{typ: name, val: buf.String(), pos: pos})
-				} else {
-					_, err := strconv.ParseFloat(buf.String(), 64)
-					if err == nil {
-						tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-					} else {
-						errorString := fmt.Sprintf("found unexpected char '%s' at index %d", string(char), i)
-						panic(errorString)
-					}
-				}
-				buf.Reset()
-			}
-			tokens = append(tokens, Token{typ: rparen, val: string(char), pos: i})
+			flush()
+			tokens = append(tokens, Token{typ: rparen, val: string(char), pos: i, end: i + 1})
 		} else {
-			errorString := fmt.Sprintf("found unexpected char '%s' at index %d", string(char), i)
-			panic(errorString)
+			flush()
+			_, size := utf8.DecodeRuneInString(expression[i:])
+			invalid(i, expression[i:i+size], fmt.Sprintf("found unexpected char '%s'", string(char)))
 		}
 	}
-	if buf.Len() > 0 {
-		if isNumber(buf.String()) {
-			tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-		} else if isFunction(buf.String()) {
-			tokens = append(tokens, Token{typ: function, val: buf.String(), pos: pos})
-		} else if isName(buf.String()) {
-			tokens = append(tokens, Token{typ: name, val: buf.String(), pos: pos})
-		} else {
-			_, err := strconv.ParseFloat(buf.String(), 64)
-			if err == nil {
-				tokens = append(tokens, Token{typ: number, val: buf.String(), pos: pos})
-			} else {
-				errorString := "found unexpected trailing chars"
-				panic(errorString)
-			}
+	flush()
+	return tokens, errs
+}
+
+// scanQuotedName returns the quoted identifier at the start of s, from the
+// opening to the closing double quote. Quoted identifiers use the escapes of
+// Go string literals, such as \" and \\, and cannot span lines. On error, the returned literal is the
+// text scanned so far.
+func scanQuotedName(s string) (string, error) {
+	end := 1
+	for end < len(s) && s[end] != '"' {
+		if s[end] == '\\' && end+1 < len(s) {
+			end++
 		}
+		end++
+	}
+	if end >= len(s) {
+		return s, fmt.Errorf("unterminated quoted name")
+	}
+	literal := s[:end+1]
+	val, err := strconv.Unquote(literal)
+	if err != nil {
+		return literal, fmt.Errorf("invalid quoted name %s", literal)
+	}
+	if val == "" {
+		return literal, fmt.Errorf("empty quoted name")
 	}
-	return tokens
+	return literal, nil
 }
 
 func isNumber(token string) bool {
@@ -228,87 +700,164 @@ func isNumber(token string) bool {
 	return err == nil
 }
 
+// constants holds the named constants, which the tokenizer reads as number
+// literals. A constant hides the environment key of the same name, which
+// stays reachable as a quoted name, and a local variable or a parameter of
+// the same name hides the constant.
+var constants = map[string]float64{
+	"pi":  math.Pi,
+	"tau": 2 * math.Pi,
+	"e":   math.E,
+	"inf": math.Inf(1),
+	"nan": math.NaN(),
+}
+
+func isConstant(token string) bool {
+	_, ok := constants[token]
+	return ok
+}
+
+// numberValue returns the value of the number literal or constant token.
+func numberValue(token string) float64 {
+	if value, ok := constants[token]; ok {
+		return value
+	}
+	value, _ := strconv.ParseFloat(token, 64)
+	return value
+}
+
+// shadowConstants turns the constants of tokens that are bound as local
+// variables or parameters back into names.
+func shadowConstants(tokens []Token, bound map[string]bool) {
+	for i, token := range tokens {
+		if token.typ == number && bound[token.val] && isConstant(token.val) {
+			tokens[i].typ = name
+		}
+	}
+}
+
+// scanNumber returns the length of the number literal at the start of s.
+// It consumes the longest run of characters that can belong to a Go
+// floating point literal, such as 1e-3, .5, 5., 1_000 or 0x1p-2, and leaves
+// validation to isNumber.
+func scanNumber(s string) int {
+	hex := strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")
+	n := 0
+	for n < len(s) {
+		c := rune(s[n])
+		if isDigit(c) || c == '.' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			n++
+			continue
+		}
+		if (c == '+' || c == '-') && n > 0 {
+			prev := s[n-1]
+			if !hex && (prev == 'e' || prev == 'E') || hex && (prev == 'p' || prev == 'P') {
+				n++
+				continue
+			}
+		}
+		break
+	}
+	return n
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
 func isAlpha(c rune) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c == '[' || c == ']') || (c >= '0' && c <= '9')
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isKeyword reports whether token is one of the logical operators spelled
+// as words.
+func isKeyword(token string) bool {
+	return token == "and" || token == "or" || token == "not"
 }
 
 func isName(token string) bool {
 	return g_name_pattern.MatchString(token)
 }
 
-func isFunction(token string) bool {
-	functions := map[string]bool{
-		"add":         true,
-		"sub":         true,
-		"mul":         true,
-		"div":         true,
-		"min":         true,
-		"max":         true,
-		"sum":         true,
-		"abs":         true,
-		"acos":        true,
-		"acosh":       true,
-		"asin":        true,
-		"asinh":       true,
-		"atan":        true,
-		"atanh":       true,
-		"cbrt":        true,
-		"ceil":        true,
-		"cos":         true,
-		"cosh":        true,
-		"erf":         true,
-		"erfc":        true,
-		"erfcinv":     true,
-		"erfinv":      true,
-		"exp":         true,
-		"exp2":        true,
-		"expm1":       true,
-		"floor":       true,
-		"gamma":       true,
-		"j0":          true,
-		"j1":          true,
-		"log":         true,
-		"log10":       true,
-		"log1p":       true,
-		"log2":        true,
-		"logb":        true,
-		"round":       true,
-		"roundToEven": true,
-		"sin":         true,
-		"sinh":        true,
-		"sqrt":        true,
-		"tan":         true,
-		"tanh":        true,
-		"trunc":       true,
-		"y0":          true,
-		"y1":          true,
-		"nanmin":      true,
-		"nanmax":      true,
-		"nanmean":     true,
-		"nanstd":      true,
-		"nansum":      true,
-		"nanprod":     true,
-		"mod":         true,
-		"pow":         true,
-		"remainder":   true,
-	}
-	return functions[token]
-}
-
-func isOperator(token string) bool {
-	return token == "+" || token == "-" || token == "*" || token == "/" || token == ","
-}
-
-func precedence(token string) int {
-	switch token {
+// operators lists the operator symbols known to the tokenizer, longest
+// first so that "**" and "<=" win over their one-character prefixes.
+var operators = []string{"**", "<=", ">=", "==", "!=", "+", "-", "*", "/", "^", "<", ">"}
+
+// operatorAt returns the operator found at byte offset i of expression, or
+// an empty string if there is none.
+func operatorAt(expression string, i int) string {
+	for _, op := range operators {
+		if strings.HasPrefix(expression[i:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// isUnary reports whether the operator at tokens[i] is a prefix operator:
+// 'not', or a '+' or '-' sign that does not follow an operand.
+func isUnary(tokens []Token, i int) bool {
+	if tokens[i].val == "not" {
+		return true
+	}
+	if tokens[i].val != "+" && tokens[i].val != "-" {
+		return false
+	}
+	return i == 0 || expectsOperand(tokens[i-1])
+}
+
+// expectsOperand reports whether the token following prev must start an
+// operand: prev is an operator or opens a group or argument.
+func expectsOperand(prev Token) bool {
+	switch prev.typ {
+	case operator, function, lparen, comma, lbracket, colon:
+		return true
+	}
+	return false
+}
+
+func precedence(token Token) int {
+	if token.typ == unary {
+		if token.val == "not" {
+			return 4
+		}
+		return 8
+	}
+	switch token.val {
+	case "or":
+		return 2
+	case "and":
+		return 3
+	case "<", "<=", ">", ">=", "==", "!=":
+		return 5
 	case "+", "-":
+		return 6
+	case "*", "/":
+		return 7
+	case "^", "**":
+		return 9
+	}
+	if token.typ == operator {
+		// the placeholder of invalid text, binding looser than any operator
+		// but tighter than the parentheses and brackets on the stack
 		return 1
-	case "*", "/", ",":
-		return 2
 	}
 	return 0
 }
 
+// popsBefore reports whether the operator top, already on the operator stack,
+// must be applied before the incoming operator token.
+func popsBefore(top, token Token) bool {
+	if isRightAssociative(token) {
+		return precedence(top) > precedence(token)
+	}
+	return precedence(top) >= precedence(token)
+}
+
+func isRightAssociative(token Token) bool {
+	return token.val == "^" || token.val == "**"
+}
+
 func PrettyPrint(w io.Writer, node *AST, indent string) {
 	if node == nil {
 		return
@@ -316,21 +865,176 @@ func PrettyPrint(w io.Writer, node *AST, indent string) {
 	if node.token.typ == number {
 		fmt.Fprintf(w, "%s%s\n", indent, node.token.val)
 		return
+	} else if node.token.typ == name {
+		fmt.Fprintf(w, "%s%s\n", indent, formatName(node.token))
+		return
+	} else if node.token.typ == let {
+		fmt.Fprintf(w, "%s%s =\n", indent, node.token.val)
+		PrettyPrint(w, node.left, indent+"  ")
+		PrettyPrint(w, node.right, indent+"  ")
+		return
 	} else if node.token.typ == slice {
-		fmt.Fprintf(w, "%s%s[%d]\n", indent, node.token.varName, node.token.varIdx)
+		fmt.Fprintf(w, "%s%s\n", indent, sliceLabel(node))
+		PrettyPrint(w, node.left, indent+"  ")
+		for _, arg := range node.args {
+			PrettyPrint(w, arg, indent+"  ")
+		}
 		return
 	}
 
 	fmt.Fprintf(w, "%s%s\n", indent, node.token.val)
 	PrettyPrint(w, node.left, indent+"  ")
 	PrettyPrint(w, node.right, indent+"  ")
+	if node.token.typ == function {
+		for _, arg := range node.args {
+			PrettyPrint(w, arg, indent+"  ")
+		}
+	}
+}
+
+// formatName returns the source form of a name token. Quoted identifiers
+// stay quoted: they name environment keys verbatim, unlike bare names.
+func formatName(token Token) string {
+	if token.quoted {
+		return strconv.Quote(token.val)
+	}
+	return token.val
 }
 
+// sliceLabel names the bounds present in a slice node, e.g. "[start::step]",
+// so that the children printed below it can be told apart.
+func sliceLabel(node *AST) string {
+	names := []string{"start", "stop", "step"}
+	parts := make([]string, len(node.token.val)+1)
+	for i := range parts {
+		if node.args[i] != nil {
+			parts[i] = names[i]
+		}
+	}
+	return "[" + strings.Join(parts, ":") + "]"
+}
+
+// ParseError describes a syntax error in an expression. Offset (in bytes),
+// Line and Column (1-based, in characters) locate the offending text Found
+// in the source, and Length is the length of Found in bytes. Expected lists
+// the kinds of tokens that would have been accepted instead, when known.
 type ParseError struct {
-	at      int
-	message string
+	Offset   int
+	Line     int
+	Column   int
+	Length   int
+	Expected []string
+	Found    string
+	Message  string
+	source   string
+}
+
+// newParseError returns an error at offset in source. Its line and column are
+// filled in by ErrorList.locate before it is returned to the caller.
+func newParseError(source string, offset int, found string, message string, expected ...string) *ParseError {
+	return &ParseError{
+		Offset:   offset,
+		Length:   len(found),
+		Expected: expected,
+		Found:    found,
+		Message:  message,
+		source:   source,
+	}
 }
 
+// lineColumn converts a byte offset in source to a 1-based line and column.
+func lineColumn(source string, offset int) (int, int) {
+	e := &ParseError{Offset: offset, source: source}
+	ErrorList{e}.locate()
+	return e.Line, e.Column
+}
+
+// Error locates the error by its byte offset in a single-line source, and by
+// line:column in a multi-line one.
 func (e *ParseError) Error() string {
-	return e.message + " at position " + strconv.Itoa(e.at)
+	if strings.Contains(e.source, "\n") {
+		return fmt.Sprintf("%s at line %d:%d", e.Message, e.Line, e.Column)
+	}
+	return e.Message + " at position " + strconv.Itoa(e.Offset)
+}
+
+// Snippet renders the source line holding the error with a caret under the
+// offending text, e.g.
+//
+//	| name + age
+//	| .....^
+func (e *ParseError) Snippet() string {
+	lines := strings.Split(e.source, "\n")
+	if e.Line < 1 || e.Line > len(lines) {
+		return ""
+	}
+	line := strings.TrimSuffix(lines[e.Line-1], "\r")
+	width := utf8.RuneCountInString(e.Found)
+	if width < 1 {
+		width = 1
+	}
+	// keep tabs in the margin so that the caret lines up with the source
+	var margin strings.Builder
+	for i, char := range []rune(line) {
+		if i == e.Column-1 {
+			break
+		}
+		if char == '\t' {
+			margin.WriteRune(char)
+		} else {
+			margin.WriteByte('.')
+		}
+	}
+	return "| " + line + "\n| " + margin.String() + strings.Repeat("^", width)
+}
+
+// ErrorList is a list of parse errors, returned by ParseExprMode when the
+// AllErrors mode is set.
+type ErrorList []*ParseError
+
+// Sort sorts the errors by position in the source.
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool { return l[i].Offset < l[j].Offset })
+}
+
+// locate fills in the line and column of the errors of a sorted list in a
+// single pass over their source, rather than scanning it for each error.
+func (l ErrorList) locate() {
+	line, column, offset := 1, 1, 0
+	for _, e := range l {
+		end := e.Offset
+		if end > len(e.source) {
+			end = len(e.source)
+		}
+		if end < offset {
+			line, column, offset = 1, 1, 0
+		}
+		for _, char := range e.source[offset:end] {
+			if char == '\n' {
+				line, column = line+1, 1
+			} else {
+				column++
+			}
+		}
+		offset = end
+		e.Line, e.Column = line, column
+	}
+}
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Err returns an error equivalent to the list, or nil if it is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
 }
@@ -2,17 +2,18 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
 func TestParseFunction(t *testing.T) {
 	var buf bytes.Buffer
 	expected := `add
-  ,
-    1
-    2
+  1
+  2
 `
 	code := `add((1) , (2))`
 	ast, err := ParseExpr(code)
@@ -30,9 +31,8 @@ func TestParseAddFunc(t *testing.T) {
 	expected := `*
   5
   add
-    ,
-      aa
-      bb
+    aa
+    bb
 `
 	code := `5 * add(aa, bb)`
 	ast, err := ParseExpr(code)
@@ -49,13 +49,11 @@ func TestParseAddpAddFunc(t *testing.T) {
 	var buf bytes.Buffer
 	expected := `+
   add
-    ,
-      aa
-      bb
+    aa
+    bb
   add
-    ,
-      cc
-      dd
+    cc
+    dd
 `
 	code := `add(aa, bb) + add(cc, dd)`
 	ast, err := ParseExpr(code)
@@ -74,10 +72,9 @@ func TestParseOperatorPrecedence(t *testing.T) {
   *
     5
     add
-      ,
-        aa
-        abs
-          bb
+      aa
+      abs
+        bb
   /
     d
     e
@@ -92,3 +89,477 @@ func TestParseOperatorPrecedence(t *testing.T) {
 	actual := buf.String()
 	assert.Equal(t, expected, actual)
 }
+
+func TestParseUnaryMinus(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `*
+  2
+  -
+    exp
+      -
+        X
+`
+	code := `2 * -exp(-X)`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	actual := buf.String()
+	assert.Equal(t, expected, actual)
+}
+
+func TestParsePowerRightAssociative(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `-
+  ^
+    2
+    **
+      3
+      2
+`
+	code := `-2 ^ 3 ** 2`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	actual := buf.String()
+	assert.Equal(t, expected, actual)
+}
+
+func TestParseComparisonPrecedence(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `<
+  where
+    >=
+      X
+      +
+        Y
+        1
+    X
+    0
+  0
+`
+	code := `where(X >= Y + 1, X, 0) < 0`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	actual := buf.String()
+	assert.Equal(t, expected, actual)
+}
+
+func TestTokenizeNumbers(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []Token
+	}{
+		{"1e-3", []Token{{typ: number, val: "1e-3", pos: 0, end: 4}}},
+		{"2.5E+10 * X", []Token{{typ: number, val: "2.5E+10", pos: 0, end: 7}, {typ: operator, val: "*", pos: 8, end: 9}, {typ: name, val: "X", pos: 10, end: 11}}},
+		{"X-6.02e23", []Token{{typ: name, val: "X", pos: 0, end: 1}, {typ: operator, val: "-", pos: 1, end: 2}, {typ: number, val: "6.02e23", pos: 2, end: 9}}},
+		{".5+5.", []Token{{typ: number, val: ".5", pos: 0, end: 2}, {typ: operator, val: "+", pos: 2, end: 3}, {typ: number, val: "5.", pos: 3, end: 5}}},
+		{"(1_000)", []Token{{typ: lparen, val: "(", pos: 0, end: 1}, {typ: number, val: "1_000", pos: 1, end: 6}, {typ: rparen, val: ")", pos: 6, end: 7}}},
+		{"0x1p-2", []Token{{typ: number, val: "0x1p-2", pos: 0, end: 6}}},
+		{"-inf < nan", []Token{{typ: operator, val: "-", pos: 0, end: 1}, {typ: number, val: "inf", pos: 1, end: 4}, {typ: operator, val: "<", pos: 5, end: 6}, {typ: number, val: "nan", pos: 7, end: 10}}},
+		{"2*pi*e", []Token{{typ: number, val: "2", pos: 0, end: 1}, {typ: operator, val: "*", pos: 1, end: 2}, {typ: number, val: "pi", pos: 2, end: 4}, {typ: operator, val: "*", pos: 4, end: 5}, {typ: number, val: "e", pos: 5, end: 6}}},
+	}
+	for _, test := range tests {
+		tokens, errs := tokenize(test.expr, 0)
+		require.Empty(t, errs, test.expr)
+		assert.Equal(t, test.expected, tokens, test.expr)
+	}
+}
+
+func TestTokenizeInvalidNumber(t *testing.T) {
+	for _, expr := range []string{"1e", "1.2.3", "1e+", "2x", ".", "0x10"} {
+		_, errs := tokenize(expr, 0)
+		assert.NotEmpty(t, errs, expr)
+	}
+}
+
+func TestParseIndexExpression(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `+
+  []
+    *
+      X
+      2
+    0
+  [start::step]
+    abs
+      Y
+    -
+      n
+    2
+`
+	code := `(X * 2)[0] + abs(Y)[-n::2]`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	actual := buf.String()
+	assert.Equal(t, expected, actual)
+}
+
+func TestParseNestedCalls(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `max
+  add
+    +
+      1
+      2
+    X
+  where
+    >
+      Y
+      0
+    Y
+    -
+      Y
+  3
+`
+	code := `max(add(1 + 2, X), where(Y > 0, Y, -Y), 3)`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	actual := buf.String()
+	assert.Equal(t, expected, actual)
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected *ParseError
+		snippet  string
+	}{
+		{
+			expr: "name + age ? 2",
+			expected: &ParseError{Offset: 11, Line: 1, Column: 12, Length: 1, Found: "?",
+				Message: "found unexpected char '?'"},
+			snippet: "| name + age ? 2\n| ...........^",
+		},
+		{
+			expr: "x + 1e+",
+			expected: &ParseError{Offset: 4, Line: 1, Column: 5, Length: 3, Found: "1e+", Expected: []string{"number"},
+				Message: "invalid number literal '1e+'"},
+			snippet: "| x + 1e+\n| ....^^^",
+		},
+		{
+			expr: "add(1, )",
+			expected: &ParseError{Offset: 7, Line: 1, Column: 8, Length: 1, Found: ")", Expected: []string{"expression"},
+				Message: "missing function argument"},
+			snippet: "| add(1, )\n| .......^",
+		},
+		{
+			expr: "sqrt(1, 2)",
+			expected: &ParseError{Offset: 0, Line: 1, Column: 1, Length: 4, Found: "sqrt",
+				Message: "function 'sqrt' expects 1 argument, got 2"},
+			snippet: "| sqrt(1, 2)\n| ^^^^",
+		},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.expr)
+		require.Error(t, err, test.expr)
+		perr, ok := err.(*ParseError)
+		require.True(t, ok, "expected a *ParseError, got %T", err)
+		assert.Equal(t, test.expected.Offset, perr.Offset, test.expr)
+		assert.Equal(t, test.expected.Line, perr.Line, test.expr)
+		assert.Equal(t, test.expected.Column, perr.Column, test.expr)
+		assert.Equal(t, test.expected.Length, perr.Length, test.expr)
+		assert.Equal(t, test.expected.Found, perr.Found, test.expr)
+		assert.Equal(t, test.expected.Expected, perr.Expected, test.expr)
+		assert.Equal(t, test.expected.Message, perr.Message, test.expr)
+		assert.Equal(t, test.snippet, perr.Snippet(), test.expr)
+	}
+}
+
+func TestLineColumn(t *testing.T) {
+	src := "a +\n  bé * c"
+	line, column := lineColumn(src, 0)
+	assert.Equal(t, []int{1, 1}, []int{line, column})
+	line, column = lineColumn(src, 6)
+	assert.Equal(t, []int{2, 3}, []int{line, column})
+	line, column = lineColumn(src, 10)
+	assert.Equal(t, []int{2, 6}, []int{line, column})
+}
+
+func TestParseExprAllErrors(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []string
+	}{
+		{"foo(1) + (2 * 3", []string{
+			"unknown function 'foo' at position 0",
+			"unbalanced parenthesis at position 14",
+		}},
+		{"1 + ? * sqrt(1, 2) + X]", []string{
+			"found unexpected char '?' at position 4",
+			"function 'sqrt' expects 1 argument, got 2 at position 8",
+			"unexpected ']' outside of brackets at position 22",
+		}},
+		{"(1))) + 1e+", []string{
+			"unbalanced parenthesis at position 3",
+			"unbalanced parenthesis at position 4",
+			"invalid number literal '1e+' at position 8",
+		}},
+		{"X + $", []string{
+			"found unexpected char '$' at position 4",
+		}},
+		{"1 +* 2 @ 3", []string{
+			"missing operand at position 3",
+			"found unexpected char '@' at position 7",
+		}},
+		{"max(X, a..b) * 2 + $$", []string{
+			"found unexpected token 'a..b' at position 7",
+			"found unexpected char '$' at position 19",
+			"found unexpected char '$' at position 20",
+		}},
+		{`"" * X`, []string{
+			"empty quoted name at position 0",
+		}},
+		{"sum + [1] , 2", []string{
+			"missing '(' after function 'sum' at position 0",
+			"unexpected '[': only values can be indexed at position 6",
+			"unexpected ',' outside of function arguments at position 10",
+		}},
+	}
+	for _, test := range tests {
+		ast, err := ParseExprMode(test.expr, AllErrors)
+		assert.Nil(t, ast, test.expr)
+		list, ok := err.(ErrorList)
+		require.True(t, ok, "expected an ErrorList, got %T", err)
+		var actual []string
+		for _, e := range list {
+			actual = append(actual, e.Error())
+		}
+		assert.Equal(t, test.expected, actual, test.expr)
+	}
+}
+
+func TestParseExprLexicalErrorFirst(t *testing.T) {
+	// the tokenizer runs before the parser, so without AllErrors the lexical
+	// error is reported rather than the earlier syntax error
+	_, err := ParseExpr("foo(X) + $")
+	assert.EqualError(t, err, "found unexpected char '$' at position 9")
+
+	_, err = ParseExprMode("foo(X) + $", AllErrors)
+	assert.EqualError(t, err, "unknown function 'foo' at position 0 (and 1 more errors)")
+}
+
+func TestParseExprManyErrors(t *testing.T) {
+	code := strings.Repeat("$", 100000) + "\n é $"
+	_, err := ParseExpr(code)
+	assert.EqualError(t, err, "found unexpected char '$' at line 1:1")
+
+	_, err = ParseExprMode(code, AllErrors)
+	list, ok := err.(ErrorList)
+	require.True(t, ok, "expected an ErrorList, got %T", err)
+	require.Len(t, list, 100002)
+	assert.Equal(t, "found unexpected char '$' at line 1:100000", list[99999].Error())
+	assert.Equal(t, "found unexpected char 'é' at line 2:2", list[100000].Error())
+	assert.Equal(t, "found unexpected char '$' at line 2:4", list[100001].Error())
+}
+
+func TestParseExprAllErrorsValid(t *testing.T) {
+	ast, err := ParseExprMode("add(1, X[2:])", AllErrors)
+	require.NoError(t, err)
+	assert.NotNil(t, ast)
+}
+
+func TestErrorList(t *testing.T) {
+	var list ErrorList
+	assert.NoError(t, list.Err())
+	list = append(list, newParseError("a $ b ?", 6, "?", "found unexpected char '?'"))
+	list = append(list, newParseError("a $ b ?", 2, "$", "found unexpected char '$'"))
+	list.Sort()
+	assert.Equal(t, "found unexpected char '$' at position 2 (and 1 more errors)", list.Err().Error())
+}
+
+func TestParseExprEdgeCases(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"", "empty expression at position 0"},
+		{"   ", "empty expression at position 0"},
+		{"*", "missing operand at position 0"},
+		{"-", "missing operand at position 0"},
+		{"aa * ", "missing operand at position 3"},
+		{"()", "missing expression in parentheses at position 1"},
+		{"add(", "unbalanced parenthesis at position 3"},
+		{"add(1 +)", "missing operand at position 7"},
+		{"1 2", "missing operator at position 2"},
+		{"X not Y", "missing operator at position 2"},
+		{"(1)(2)", "missing operator at position 3"},
+		{"X[1 *:]", "missing operand at position 5"},
+	}
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		assert.Nil(t, ast, test.expr)
+		require.IsType(t, &ParseError{}, err, test.expr)
+		assert.Equal(t, test.expected, err.Error(), test.expr)
+	}
+}
+
+func TestParseExprDeepNesting(t *testing.T) {
+	const depth = 100000
+	code := strings.Repeat("(", depth) + "1" + strings.Repeat(")", depth)
+	_, err := ParseExpr(code)
+	assert.NoError(t, err)
+	_, err = ParseExpr(code[:len(code)-1])
+	assert.EqualError(t, err, fmt.Sprintf("unbalanced parenthesis at position %d", len(code)-2))
+}
+
+func FuzzParseExpr(f *testing.F) {
+	for _, seed := range []string{
+		"", "(", ")", "()", "add(", "add(1, 2)", "X[1:2:3]", "X[::-1]", "-X ** 2",
+		"not X > 0 and Y < 1", "where(X > 0, X, -X)[0]", "1e-3 + .5", "sum + [1] , 2",
+		`"cpu load" + "a\"b"`, `"unterminated`,
+		"lo = nanmin(X); hi = nanmax(X); (X - lo) / (hi - lo)", "a = ; = 1;",
+		"def f(x, y) = x * y; f(X, 2)", "def f(x) = f(x); def(",
+		"pi = 3; 2 * pi * e", "def f(e) = e * tau; f(nan)",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, code string) {
+		ast, err := ParseExpr(code)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("%q: expected a *ParseError, got %T", code, err)
+			}
+			if ast != nil {
+				t.Fatalf("%q: got an AST along with error %v", code, err)
+			}
+		} else if ast == nil {
+			t.Fatalf("%q: got neither an AST nor an error", code)
+		} else {
+			source := Format(ast)
+			again, err := ParseExpr(source)
+			if err != nil {
+				t.Fatalf("%q: formatted as %q which does not parse: %v", code, source, err)
+			}
+			if treeString(again) != treeString(ast) {
+				t.Fatalf("%q: formatted as %q which parses to a different tree", code, source)
+			}
+		}
+		_, all := ParseExprMode(code, AllErrors)
+		if (err == nil) != (all == nil) {
+			t.Fatalf("%q: ParseExpr error %v but AllErrors error %v", code, err, all)
+		}
+	})
+}
+
+func TestTokenizeQuotedNames(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []Token
+	}{
+		{`"cpu load" * 2`, []Token{{typ: name, val: "cpu load", pos: 0, end: 10, quoted: true}, {typ: operator, val: "*", pos: 11, end: 12}, {typ: number, val: "2", pos: 13, end: 14}}},
+		{`"node:mem-free"[0]`, []Token{{typ: name, val: "node:mem-free", pos: 0, end: 15, quoted: true}, {typ: lbracket, val: "[", pos: 15, end: 16}, {typ: number, val: "0", pos: 16, end: 17}, {typ: rbracket, val: "]", pos: 17, end: 18}}},
+		{`"say \"hi\" \\ bye"`, []Token{{typ: name, val: `say "hi" \ bye`, pos: 0, end: 19, quoted: true}}},
+		{`"é"+X`, []Token{{typ: name, val: "é", pos: 0, end: 4, quoted: true}, {typ: operator, val: "+", pos: 4, end: 5}, {typ: name, val: "X", pos: 5, end: 6}}},
+	}
+	for _, test := range tests {
+		tokens, errs := tokenize(test.expr, 0)
+		require.Empty(t, errs, test.expr)
+		assert.Equal(t, test.expected, tokens, test.expr)
+	}
+}
+
+func TestTokenizeInvalidQuotedNames(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`1 + "cpu`, "unterminated quoted name at position 4"},
+		{`"cpu\"`, "unterminated quoted name at position 0"},
+		{`"" + 1`, "empty quoted name at position 0"},
+		{`"a\qb"`, `invalid quoted name "a\qb" at position 0`},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.expr)
+		require.Error(t, err, test.expr)
+		assert.Equal(t, test.expected, err.Error(), test.expr)
+	}
+}
+
+func TestPrettyPrintQuotedNames(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `+
+  "cpu load"
+  *
+    "X"
+    -
+      "sum"
+      "a.b"
+`
+	code := `"cpu load" + "X" * ("sum" - "a.b")`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestParseProgram(t *testing.T) {
+	var buf bytes.Buffer
+	expected := `lo =
+  nanmin
+    X
+  hi =
+    nanmax
+      X
+    /
+      -
+        X
+        lo
+      -
+        hi
+        lo
+`
+	code := `lo = nanmin(X); hi = nanmax(X); (X - lo) / (hi - lo)`
+	ast, err := ParseExpr(code)
+	require.NoError(t, err, "ParseExpr returned an error")
+	PrettyPrint(&buf, ast, "")
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestParseProgramErrors(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"a = 1", "missing result expression after the assignment to 'a' at position 0"},
+		{"a = 1;", "missing result expression after ';' at position 5"},
+		{"; a", "empty statement before ';' at position 0"},
+		{"a = ; a", "missing expression after '=' at position 2"},
+		{"y = lo * 2; lo = 1; y", "'lo' is used before it is defined at position 4"},
+		{"x = x + 1; x", "'x' is used before it is defined at position 4"},
+		{"sum = 1; 2", "cannot assign to 'sum' at position 0"},
+		{"host.cpu = 1; 2", "cannot assign to 'host.cpu' at position 0"},
+		{"1; 2", "only the last statement can be an expression, others must be assignments at position 0"},
+		{"a == 1 = 2", "unexpected '=': assignments must start a statement at position 7"},
+		{"a = (1; 2)", "unbalanced parenthesis at position 5"},
+	}
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		assert.Nil(t, ast, test.expr)
+		require.Error(t, err, test.expr)
+		assert.Equal(t, test.expected, err.Error(), test.expr)
+	}
+}
+
+func TestTokenizeWhitespaceAndComments(t *testing.T) {
+	code := "# normalised\n\tlo = nanmin(X); // lowest\r\n\thi\t=\tnanmax(X) # highest\n"
+	tokens, errs := tokenize(code, 0)
+	require.Empty(t, errs)
+	var vals []string
+	for _, token := range tokens {
+		vals = append(vals, token.val)
+	}
+	assert.Equal(t, []string{"lo", "=", "nanmin", "(", "X", ")", ";", "hi", "=", "nanmax", "(", "X", ")"}, vals)
+	assert.Equal(t, 14, tokens[0].pos)
+}
+
+func TestParseErrorLineColumn(t *testing.T) {
+	code := "lo = nanmin(X); # lowest\nhi = nanmax(X);\n\t(X - lo) / (hi - lo"
+	_, err := ParseExpr(code)
+	require.Error(t, err)
+	assert.Equal(t, "unbalanced parenthesis at line 3:19", err.Error())
+	perr := err.(*ParseError)
+	assert.Equal(t, "| \t(X - lo) / (hi - lo\n| \t.................^^", perr.Snippet())
+}
@@ -0,0 +1,569 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strings"
+)
+
+// A compiled program is encoded as its tree of nodes together with the
+// bodies of the functions defined with def that it calls, so that a decoded
+// program evaluates the same way in a process where those functions are not
+// registered. Go functions cannot be encoded: calls to functions given to
+// ParseExprFuncs or RegisterFunc decode as calls to the function registered
+// under the same name. Decoding validates the tree as the parser would,
+// including the arity and the static types of the arguments of calls, so
+// that a corrupted or hand-edited program is rejected instead of failing in
+// Evaluate.
+//
+// The binary form is the magic "expr", the format version as a uvarint, the
+// program, and the CRC-32 (IEEE) of all the preceding bytes. The JSON form is
+// an object with the fields of encodedProgram, whose nodes are written with
+// the layout of JSONNode, as PrintJSON does, extended with the fields that
+// decoding needs.
+
+// encodingVersion is the version of the encoding written by MarshalBinary
+// and MarshalJSON, and the only one they can decode.
+const encodingVersion = 1
+
+var binaryMagic = []byte("expr")
+
+type encodedProgram struct {
+	Version int           `json:"version"`
+	Defs    []*encodedDef `json:"defs,omitempty"` // callees first
+	Root    *encodedNode  `json:"root"`
+}
+
+type encodedDef struct {
+	Name   string       `json:"name"`
+	Params []string     `json:"params"`
+	Body   *encodedNode `json:"body"`
+}
+
+// encodedNode holds the fields of the JSONNode of a node, and the children
+// of the node in the order of AST.Children. The span of a node does not
+// locate its operator, nor tell whether parentheses surround it, which
+// Token and Parens add for the parser errors and the spans of the decoded
+// program, and a call records the definition of the function it calls.
+type encodedNode struct {
+	Kind     string         `json:"kind"`
+	Op       string         `json:"op,omitempty"`
+	Name     string         `json:"name,omitempty"`
+	Quoted   bool           `json:"quoted,omitempty"`
+	Literal  string         `json:"literal,omitempty"`
+	Span     [2]int         `json:"span"`
+	Children []*encodedNode `json:"children,omitempty"`
+	Token    *[2]int        `json:"token,omitempty"`  // span of the operator, name or literal, when it differs from Span
+	Parens   bool           `json:"parens,omitempty"` // Span is that of the parentheses around the node
+	Def      int            `json:"def,omitempty"`    // 1 + index in Defs of the called function
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler for a compiled program.
+func (n *AST) MarshalBinary() ([]byte, error) {
+	if n == nil {
+		return nil, fmt.Errorf("cannot encode a nil program")
+	}
+	var w binaryWriter
+	w.buf = append(w.buf, binaryMagic...)
+	w.uvarint(encodingVersion)
+	w.program(encodeProgram(n))
+	return binary.BigEndian.AppendUint32(w.buf, crc32.ChecksumIEEE(w.buf)), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It replaces n with
+// the program encoded by MarshalBinary, and returns an error if data is not
+// a valid encoding.
+func (n *AST) UnmarshalBinary(data []byte) error {
+	if len(data) < len(binaryMagic)+4 || !bytes.HasPrefix(data, binaryMagic) {
+		return invalidProgram("missing header")
+	}
+	payload := data[:len(data)-4]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return invalidProgram("checksum mismatch")
+	}
+	r := binaryReader{data: payload[len(binaryMagic):]}
+	version := r.uvarint()
+	if r.err == nil && version != encodingVersion {
+		return fmt.Errorf("unsupported program encoding version %d", version)
+	}
+	program := r.program()
+	if r.err == nil && len(r.data) > 0 {
+		r.fail("unexpected data after the program")
+	}
+	if r.err != nil {
+		return r.err
+	}
+	program.Version = version
+	return n.decode(program)
+}
+
+// MarshalJSON implements json.Marshaler for a compiled program.
+func (n *AST) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodeProgram(n))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It replaces n with the program
+// encoded by MarshalJSON, and returns an error if data is not a valid
+// encoding.
+func (n *AST) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var program encodedProgram
+	if err := json.Unmarshal(data, &program); err != nil {
+		return err
+	}
+	if program.Version != encodingVersion {
+		return fmt.Errorf("unsupported program encoding version %d", program.Version)
+	}
+	return n.decode(&program)
+}
+
+func (n *AST) decode(program *encodedProgram) error {
+	var d decoder
+	for _, def := range program.Defs {
+		if err := d.def(def); err != nil {
+			return err
+		}
+	}
+	d.bound, d.assigned = make(map[string]bool), make(map[string]bool)
+	for en := program.Root; en != nil && en.Kind == LetExpr.String() && len(en.Children) == 2; en = en.Children[1] {
+		d.assigned[en.Name] = true
+	}
+	root, err := d.node(program.Root, true)
+	if err != nil {
+		return err
+	}
+	if err := checkDecodedTypes(root); err != nil {
+		return err
+	}
+	*n = *root
+	return nil
+}
+
+// checkDecodedTypes rejects the calls in node whose arguments have a static
+// type that the parser rejects.
+func checkDecodedTypes(node *AST) error {
+	var err error
+	typeErrors(node, func(_ *AST, message string, _ Type) {
+		if err == nil {
+			err = invalidProgram("%s", message)
+		}
+	})
+	return err
+}
+
+func invalidProgram(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid encoded program: "+format, args...)
+}
+
+func encodeProgram(node *AST) *encodedProgram {
+	e := encoder{index: make(map[*FuncDef]int)}
+	root := e.node(node)
+	return &encodedProgram{Version: encodingVersion, Defs: e.defs, Root: root}
+}
+
+type encoder struct {
+	defs  []*encodedDef
+	index map[*FuncDef]int // 1 + index in defs
+}
+
+func (e *encoder) node(n *AST) *encodedNode {
+	if n == nil {
+		return nil
+	}
+	j := jsonFields(n)
+	en := &encodedNode{
+		Kind:    j.Kind,
+		Op:      j.Op,
+		Name:    j.Name,
+		Quoted:  j.Quoted,
+		Literal: j.Literal,
+		Span:    j.Span,
+		Parens:  n.parens != nil,
+	}
+	if token := [2]int{n.token.pos, n.token.end}; token != j.Span {
+		en.Token = &token
+	}
+	if n.token.def != nil {
+		en.Def = e.def(n.token.def)
+	}
+	for _, child := range n.Children() {
+		en.Children = append(en.Children, e.node(child))
+	}
+	return en
+}
+
+// def returns the reference to def, encoding it after the functions it calls
+// the first time it is seen.
+func (e *encoder) def(def *FuncDef) int {
+	if i, ok := e.index[def]; ok {
+		return i
+	}
+	body := e.node(def.body)
+	e.defs = append(e.defs, &encodedDef{Name: def.Name, Params: def.Params, Body: body})
+	e.index[def] = len(e.defs)
+	return len(e.defs)
+}
+
+type decoder struct {
+	defs     []*FuncDef
+	bound    map[string]bool // parameters and local variables in scope
+	assigned map[string]bool // local variables of the program
+}
+
+// def decodes a function definition. Its body can only call the functions
+// decoded before it, so that decoded functions cannot call themselves.
+func (d *decoder) def(ed *encodedDef) error {
+	if ed == nil {
+		return invalidProgram("missing function definition")
+	}
+	if !isLocalName(ed.Name) || isConstant(ed.Name) {
+		return invalidProgram("invalid function name '%s'", ed.Name)
+	}
+	params := make(map[string]bool)
+	for _, param := range ed.Params {
+		if !isLocalName(param) || params[param] {
+			return invalidProgram("invalid parameter '%s' of function '%s'", param, ed.Name)
+		}
+		params[param] = true
+	}
+	d.bound, d.assigned = params, nil
+	body, err := d.node(ed.Body, false)
+	if err != nil {
+		return err
+	}
+	if err := checkDecodedTypes(body); err != nil {
+		return err
+	}
+	d.defs = append(d.defs, &FuncDef{Name: ed.Name, Params: append([]string(nil), ed.Params...), body: body})
+	return nil
+}
+
+// node decodes en and its children. A LetExpr can only be the program, or
+// the body of another LetExpr, which top reports.
+func (d *decoder) node(en *encodedNode, top bool) (*AST, error) {
+	if en == nil {
+		return nil, invalidProgram("missing node")
+	}
+	span := en.Span
+	if en.Token != nil {
+		span = *en.Token
+	}
+	for _, s := range [][2]int{en.Span, span} {
+		if s[0] < 0 || s[1] < s[0] {
+			return nil, invalidProgram("invalid span %d:%d", s[0], s[1])
+		}
+	}
+	token := Token{pos: span[0], end: span[1], quoted: en.Quoted}
+	children := len(en.Children)
+	switch en.Kind {
+	case NumberLit.String():
+		token.typ, token.val = number, en.Literal
+		// a constant is hidden by a variable of the same name
+		if !scansAsNumber(token.val) || d.bound[token.val] || d.assigned[token.val] {
+			return nil, invalidProgram("invalid number '%s'", token.val)
+		}
+		children = 0
+	case Ident.String():
+		token.typ, token.val = name, en.Name
+		if token.val == "" || !en.Quoted && (!scansAsName(token.val) || isConstant(token.val) && !d.bound[token.val]) {
+			return nil, invalidProgram("invalid name '%s'", token.val)
+		}
+		if !en.Quoted && d.assigned[token.val] && !d.bound[token.val] {
+			return nil, invalidProgram("'%s' is used before it is defined", token.val)
+		}
+		children = 0
+	case UnaryExpr.String():
+		token.typ, token.val = unary, en.Op
+		if token.val != "-" && token.val != "+" && token.val != "not" {
+			return nil, invalidProgram("invalid unary operator '%s'", token.val)
+		}
+		children = 1
+	case BinaryExpr.String():
+		token.typ, token.val = operator, en.Op
+		if token.val != "and" && token.val != "or" && (token.val == "" || operatorAt(token.val, 0) != token.val) {
+			return nil, invalidProgram("invalid operator '%s'", token.val)
+		}
+		children = 2
+	case CallExpr.String():
+		token.typ, token.val = function, en.Name
+		token.arity = len(en.Children)
+		if en.Def != 0 {
+			if en.Def < 0 || en.Def > len(d.defs) {
+				return nil, invalidProgram("undefined function %d", en.Def)
+			}
+			token.def = d.defs[en.Def-1]
+			if token.def.Name != token.val {
+				return nil, invalidProgram("call to '%s' refers to function '%s'", token.val, token.def.Name)
+			}
+		} else if token.fn = lookupBuiltin(token.val); token.fn == nil {
+			// Go functions are not encoded: the decoded program calls the
+			// function registered under the same name
+			if token.fn = lookupFunc(token.val); token.fn == nil {
+				return nil, invalidProgram("unknown function '%s'", token.val)
+			}
+		}
+		if err := checkArity("", token); err != nil {
+			return nil, invalidProgram("%s", err.Message)
+		}
+	case IndexExpr.String():
+		token.typ, token.val = index, "[]"
+		children = 2
+	case SliceExpr.String():
+		token.typ, token.val = slice, en.Op
+		if token.val != ":" && token.val != "::" {
+			return nil, invalidProgram("invalid slice '%s'", token.val)
+		}
+		children = 4
+	case LetExpr.String():
+		token.typ, token.val = let, en.Name
+		if !top {
+			return nil, invalidProgram("local variable '%s' must be bound at the start of the program", token.val)
+		}
+		if !isLocalName(token.val) {
+			return nil, invalidProgram("invalid variable name '%s'", token.val)
+		}
+		children = 2
+	default:
+		return nil, invalidProgram("unknown node kind '%s'", en.Kind)
+	}
+	// the fields of other kinds must be empty
+	text := token.val
+	if token.typ == index {
+		text = ""
+	}
+	if en.Op+en.Name+en.Literal != text || en.Quoted && token.typ != name {
+		return nil, invalidProgram("%s has fields of other kinds", en.Kind)
+	}
+	if len(en.Children) != children {
+		return nil, invalidProgram("%s has %d children, expected %d", en.Kind, len(en.Children), children)
+	}
+	if en.Def != 0 && token.typ != function {
+		return nil, invalidProgram("%s cannot refer to a function", en.Kind)
+	}
+
+	nodes := make([]*AST, children)
+	for i, child := range en.Children {
+		// the bounds of a slice are optional, and a single colon has no step
+		optional := token.typ == slice && i > 0
+		if child == nil && optional {
+			continue
+		}
+		if optional && i == 3 && token.val == ":" {
+			return nil, invalidProgram("slice '%s' cannot have a step", token.val)
+		}
+		if token.typ == let && i == 1 {
+			d.bound[token.val] = true
+		}
+		node, err := d.node(child, token.typ == let && i == 1)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+
+	node := &AST{token: token}
+	switch token.typ {
+	case unary:
+		node.right = nodes[0]
+	case function:
+		node.args = nodes
+	case slice:
+		node.left = nodes[0]
+		node.args = nodes[1:]
+	case operator, index, let:
+		node.left, node.right = nodes[0], nodes[1]
+	}
+	if en.Parens {
+		node.parens = &Token{typ: paren, pos: en.Span[0], end: en.Span[1]}
+	} else if node.Pos() != en.Span[0] || node.End() != en.Span[1] {
+		return nil, invalidProgram("invalid span %d:%d of %s at %d:%d", en.Span[0], en.Span[1], en.Kind, node.Pos(), node.End())
+	}
+	return node, nil
+}
+
+// scansAsNumber reports whether the tokenizer reads s as a number literal
+// or a constant.
+func scansAsNumber(s string) bool {
+	tokens, errs := tokenize(s, 0)
+	return len(errs) == 0 && len(tokens) == 1 && tokens[0].typ == number && tokens[0].val == s
+}
+
+// scansAsName reports whether s can be written as an unquoted name: the
+// tokenizer reads it as a name, or as a constant hidden by a local variable
+// or a parameter.
+func scansAsName(s string) bool {
+	tokens, errs := tokenize(s, 0)
+	if len(errs) > 0 || len(tokens) != 1 || tokens[0].val != s {
+		return false
+	}
+	switch tokens[0].typ {
+	case name:
+		return true
+	case number:
+		return isConstant(s) // bound as a local variable or a parameter
+	}
+	return false
+}
+
+// isLocalName reports whether s can name a function, a parameter or a local
+// variable.
+func isLocalName(s string) bool {
+	return scansAsName(s) && !strings.Contains(s, ".")
+}
+
+type binaryWriter struct {
+	buf []byte
+}
+
+func (w *binaryWriter) uvarint(v int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(v))
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(len(s))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binaryWriter) program(program *encodedProgram) {
+	w.uvarint(len(program.Defs))
+	for _, def := range program.Defs {
+		w.string(def.Name)
+		w.uvarint(len(def.Params))
+		for _, param := range def.Params {
+			w.string(param)
+		}
+		w.node(def.Body)
+	}
+	w.node(program.Root)
+}
+
+// node writes 0 for a nil node, and otherwise 1 + its Kind, its operator,
+// name or literal, its spans and flags, and its children.
+func (w *binaryWriter) node(en *encodedNode) {
+	if en == nil {
+		w.uvarint(0)
+		return
+	}
+	kind := 0
+	for k, name := range kindNames {
+		if name == en.Kind {
+			kind = k
+		}
+	}
+	w.uvarint(kind + 1)
+	w.string(en.Op + en.Name + en.Literal)
+	w.uvarint(en.Span[0])
+	w.uvarint(en.Span[1])
+	flags := 0
+	if en.Quoted {
+		flags |= 1
+	}
+	if en.Parens {
+		flags |= 2
+	}
+	if en.Token != nil {
+		flags |= 4
+	}
+	w.uvarint(flags)
+	if en.Token != nil {
+		w.uvarint(en.Token[0])
+		w.uvarint(en.Token[1])
+	}
+	w.uvarint(en.Def)
+	w.uvarint(len(en.Children))
+	for _, child := range en.Children {
+		w.node(child)
+	}
+}
+
+// binaryReader reads the encoding of binaryWriter. After the first error,
+// it returns zero values and keeps the error in err.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(message string) {
+	if r.err == nil {
+		r.err = invalidProgram("%s", message)
+	}
+}
+
+func (r *binaryReader) uvarint() int {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 || v > math.MaxInt32 {
+		r.fail("truncated or invalid integer")
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(v)
+}
+
+// count reads the length of a list, which cannot exceed the number of bytes
+// left since each element takes at least one.
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > len(r.data) {
+		r.fail("truncated list")
+		return 0
+	}
+	return n
+}
+
+func (r *binaryReader) string() string {
+	n := r.count()
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binaryReader) program() *encodedProgram {
+	program := &encodedProgram{}
+	for i, n := 0, r.count(); i < n && r.err == nil; i++ {
+		def := &encodedDef{Name: r.string()}
+		for j, m := 0, r.count(); j < m && r.err == nil; j++ {
+			def.Params = append(def.Params, r.string())
+		}
+		def.Body = r.node()
+		program.Defs = append(program.Defs, def)
+	}
+	program.Root = r.node()
+	return program
+}
+
+func (r *binaryReader) node() *encodedNode {
+	kind := r.uvarint()
+	if kind == 0 || r.err != nil {
+		return nil
+	}
+	en := &encodedNode{Kind: Kind(kind - 1).String()}
+	switch text := r.string(); Kind(kind - 1) {
+	case NumberLit:
+		en.Literal = text
+	case Ident, CallExpr, LetExpr:
+		en.Name = text
+	default:
+		en.Op = text
+	}
+	en.Span = [2]int{r.uvarint(), r.uvarint()}
+	flags := r.uvarint()
+	en.Quoted = flags&1 != 0
+	en.Parens = flags&2 != 0
+	if flags&4 != 0 {
+		en.Token = &[2]int{r.uvarint(), r.uvarint()}
+	}
+	en.Def = r.uvarint()
+	for i, n := 0, r.count(); i < n && r.err == nil; i++ {
+		en.Children = append(en.Children, r.node())
+	}
+	return en
+}
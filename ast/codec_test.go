@@ -0,0 +1,173 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+var codecSources = []string{
+	"1 + 2 * 3",
+	"-(X + 1e-3) ^ 2 ** .5",
+	`not X > 0 and "cpu load" != host.cpu.idle or M`,
+	"where(X > 0, X, nan)[::-1] + X[1:-1] + X[:2] + abs(X)[0]",
+	"lo = nanmin(X); hi = nanmax(X); ((X - lo)) / (hi - lo)",
+	"def sq(v) = v * v; def norm(v) = sqrt(nansum(sq(v))); norm(X) + sq(2)",
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, source := range codecSources {
+		program, err := ParseExpr(source)
+		require.NoError(t, err, source)
+		data, err := program.MarshalBinary()
+		require.NoError(t, err, source)
+
+		var decoded AST
+		require.NoError(t, decoded.UnmarshalBinary(data), source)
+		assert.Equal(t, treeString(program), treeString(&decoded), source)
+		assert.Equal(t, Format(program), Format(&decoded), source)
+		assert.Equal(t, program.Pos(), decoded.Pos(), source)
+		assert.Equal(t, program.End(), decoded.End(), source)
+		again, err := decoded.MarshalBinary()
+		require.NoError(t, err, source)
+		assert.Equal(t, data, again, source)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	for _, source := range codecSources {
+		program, err := ParseExpr(source)
+		require.NoError(t, err, source)
+		data, err := json.Marshal(program)
+		require.NoError(t, err, source)
+
+		var decoded *AST
+		require.NoError(t, json.Unmarshal(data, &decoded), source)
+		assert.Equal(t, Format(program), Format(decoded), source)
+		again, err := json.Marshal(decoded)
+		require.NoError(t, err, source)
+		assert.JSONEq(t, string(data), string(again), source)
+	}
+
+	program, err := ParseExpr(`-X[1:]`)
+	require.NoError(t, err)
+	data, err := json.Marshal(program)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "root":
+		{"kind": "UnaryExpr", "op": "-", "span": [0, 6], "token": [0, 1], "children": [
+			{"kind": "SliceExpr", "op": ":", "span": [1, 6], "token": [5, 6], "children": [
+				{"kind": "Ident", "name": "X", "span": [1, 2]},
+				{"kind": "NumberLit", "literal": "1", "span": [3, 4]},
+				null,
+				null
+			]}
+		]}
+	}`, string(data))
+
+	// the nodes extend the layout of PrintJSON
+	var buf bytes.Buffer
+	require.NoError(t, PrintJSON(&buf, program))
+	var printed, encoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &printed))
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	root := encoded["root"].(map[string]interface{})
+	delete(root, "token")
+	slice := root["children"].([]interface{})[0].(map[string]interface{})
+	delete(slice, "token")
+	assert.Equal(t, printed, root)
+
+	program, err = ParseExpr(`(X + 1) * 2`)
+	require.NoError(t, err)
+	data, err = json.Marshal(program)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "root":
+		{"kind": "BinaryExpr", "op": "*", "span": [0, 11], "token": [8, 9], "children": [
+			{"kind": "BinaryExpr", "op": "+", "span": [0, 7], "token": [3, 4], "parens": true, "children": [
+				{"kind": "Ident", "name": "X", "span": [1, 2]},
+				{"kind": "NumberLit", "literal": "1", "span": [5, 6]}
+			]},
+			{"kind": "NumberLit", "literal": "2", "span": [10, 11]}
+		]}
+	}`, string(data))
+}
+
+func TestMarshalDefinedFunction(t *testing.T) {
+	def, err := ParseDef("def testclip(v) = where(v > 1, 1, v)")
+	require.NoError(t, err)
+	Define(def)
+	program, err := ParseExpr("testclip(X)")
+	Undefine("testclip")
+	require.NoError(t, err)
+	data, err := program.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded AST
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	env := &Env{"X": []float64{0.5, 2}}
+	assert.Equal(t, []float64{0.5, 1}, Evaluate(&decoded, env))
+	assert.Equal(t, "def testclip(v) = where(v > 1, 1, v); testclip(X)", Format(&decoded))
+}
+
+func TestUnmarshalBinaryCorrupted(t *testing.T) {
+	program, err := ParseExpr(codecSources[len(codecSources)-1])
+	require.NoError(t, err)
+	data, err := program.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded AST
+	for i := 0; i < len(data); i++ {
+		assert.Error(t, decoded.UnmarshalBinary(data[:i]), "truncated to %d bytes", i)
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0x40
+		assert.Error(t, decoded.UnmarshalBinary(corrupted), "byte %d flipped", i)
+	}
+	assert.EqualError(t, decoded.UnmarshalBinary([]byte("exprdata")), "invalid encoded program: checksum mismatch")
+	assert.EqualError(t, decoded.UnmarshalBinary(nil), "invalid encoded program: missing header")
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{`{"version": 2, "root": {"kind": "Ident", "name": "X"}}`, "unsupported program encoding version 2"},
+		{`{"version": 1}`, "invalid encoded program: missing node"},
+		{`{"version": 1, "root": {"kind": "Tuple"}}`, "invalid encoded program: unknown node kind 'Tuple'"},
+		{`{"version": 1, "root": {"kind": "NumberLit", "literal": "1x"}}`, "invalid encoded program: invalid number '1x'"},
+		{`{"version": 1, "root": {"kind": "Ident", "name": "a b"}}`, "invalid encoded program: invalid name 'a b'"},
+		{`{"version": 1, "root": {"kind": "Ident", "name": "X", "span": [2, 1]}}`, "invalid encoded program: invalid span 2:1"},
+		{`{"version": 1, "root": {"kind": "Ident", "name": "X", "span": [0, 1], "token": [1, 0]}}`, "invalid encoded program: invalid span 1:0"},
+		{`{"version": 1, "root": {"kind": "Ident", "name": "X", "span": [0, 1], "token": [2, 3]}}`, "invalid encoded program: invalid span 0:1 of Ident at 2:3"},
+		{`{"version": 1, "root": {"kind": "NumberLit", "literal": "1", "name": "X"}}`, "invalid encoded program: NumberLit has fields of other kinds"},
+		{`{"version": 1, "root": {"kind": "NumberLit", "literal": "1", "quoted": true}}`, "invalid encoded program: NumberLit has fields of other kinds"},
+		{`{"version": 1, "root": {"kind": "UnaryExpr", "op": "-", "children": [{"kind": "LetExpr", "name": "a"}]}}`, "invalid encoded program: local variable 'a' must be bound at the start of the program"},
+		{`{"version": 1, "root": {"kind": "BinaryExpr", "op": "%","children": [null, null]}}`, "invalid encoded program: invalid operator '%'"},
+		{`{"version": 1, "root": {"kind": "BinaryExpr", "op": "+", "children": [{"kind": "Ident", "name": "X"}]}}`, "invalid encoded program: BinaryExpr has 1 children, expected 2"},
+		{`{"version": 1, "root": {"kind": "CallExpr", "name": "nope"}}`, "invalid encoded program: unknown function 'nope'"},
+		{`{"version": 1, "root": {"kind": "CallExpr", "name": "sqrt"}}`, "invalid encoded program: function 'sqrt' expects 1 argument, got 0"},
+		{`{"version": 1, "root": {"kind": "CallExpr", "name": "f", "def": 1}}`, "invalid encoded program: undefined function 1"},
+		{`{"version": 1, "defs": [{"name": "f", "params": [], "body": {"kind": "CallExpr", "name": "f", "def": 1}}], "root": {"kind": "NumberLit", "literal": "1"}}`, "invalid encoded program: undefined function 1"},
+		{`{"version": 1, "defs": [{"name": "f", "params": ["v", "v"], "body": {"kind": "Ident", "name": "v"}}], "root": {"kind": "NumberLit", "literal": "1"}}`, "invalid encoded program: invalid parameter 'v' of function 'f'"},
+		{`{"version": 1, "root": {"kind": "SliceExpr", "op": ":", "children": [{"kind": "Ident", "name": "X"}, null, null, {"kind": "NumberLit", "literal": "2"}]}}`, "invalid encoded program: slice ':' cannot have a step"},
+		{`{"version": 1, "root": {"kind": "SliceExpr", "op": "::", "children": [null, null, null, null]}}`, "invalid encoded program: missing node"},
+		{`{"version": 1, "root": {"kind": "NumberLit", "literal": "Inf"}}`, "invalid encoded program: invalid number 'Inf'"},
+		{`{"version": 1, "root": {"kind": "Ident", "name": "pi"}}`, "invalid encoded program: invalid name 'pi'"},
+		{`{"version": 1, "root": {"kind": "IndexExpr", "op": "x", "children": [{"kind": "Ident", "name": "X"}, {"kind": "NumberLit", "literal": "1"}]}}`, "invalid encoded program: IndexExpr has fields of other kinds"},
+		{`{"version": 1, "root": {"kind": "LetExpr", "name": "lo", "children": [{"kind": "Ident", "name": "lo"}, {"kind": "Ident", "name": "lo"}]}}`, "invalid encoded program: 'lo' is used before it is defined"},
+		{`{"version": 1, "root": {"kind": "LetExpr", "name": "pi", "children": [{"kind": "NumberLit", "literal": "1"}, {"kind": "NumberLit", "literal": "pi"}]}}`, "invalid encoded program: invalid number 'pi'"},
+		{`{"version": 1, "root": {"kind": "CallExpr", "name": "nanmax", "children": [{"kind": "NumberLit", "literal": "e"}]}}`, "invalid encoded program: function 'nanmax' expects vector for argument 1, got scalar"},
+		{`{"version": 1, "root": {"kind": "CallExpr", "name": "where", "children": [
+			{"kind": "BinaryExpr", "op": "-", "children": [{"kind": "Ident", "name": "X"}, {"kind": "NumberLit", "literal": "2"}]},
+			{"kind": "Ident", "name": "X"},
+			{"kind": "Ident", "name": "X"}
+		]}}`, "invalid encoded program: function 'where' expects bool or mask for argument 1, got scalar or vector"},
+		{`{"version": 1, "defs": [{"name": "e", "params": ["x"], "body": {"kind": "Ident", "name": "x"}}], "root": {"kind": "CallExpr", "name": "e", "def": 1, "children": [{"kind": "Ident", "name": "X"}]}}`, "invalid encoded program: invalid function name 'e'"},
+		{`{"version": 1, "defs": [{"name": "f", "params": ["v"], "body": {"kind": "CallExpr", "name": "sum", "children": [{"kind": "NumberLit", "literal": "1"}]}}], "root": {"kind": "NumberLit", "literal": "1"}}`, "invalid encoded program: function 'sum' expects vector for argument 1, got scalar"},
+	}
+	for _, test := range tests {
+		var decoded AST
+		assert.EqualError(t, json.Unmarshal([]byte(test.data), &decoded), test.expected, test.data)
+	}
+}
@@ -0,0 +1,84 @@
+package ast
+
+import (
+	"fmt"
+)
+
+// Comparison operators return a bool when both operands are scalars and a
+// []bool mask when at least one of them is a vector. Scalars are broadcast to
+// the length of the vector operand, the same way arithmetic operators do.
+
+func less(a, b interface{}) interface{} {
+	return compare(a, b, "<", func(x, y float64) bool { return x < y })
+}
+
+func lessEqual(a, b interface{}) interface{} {
+	return compare(a, b, "<=", func(x, y float64) bool { return x <= y })
+}
+
+func greater(a, b interface{}) interface{} {
+	return compare(a, b, ">", func(x, y float64) bool { return x > y })
+}
+
+func greaterEqual(a, b interface{}) interface{} {
+	return compare(a, b, ">=", func(x, y float64) bool { return x >= y })
+}
+
+func equal(a, b interface{}) interface{} {
+	return compare(a, b, "==", func(x, y float64) bool { return x == y })
+}
+
+func notEqual(a, b interface{}) interface{} {
+	return compare(a, b, "!=", func(x, y float64) bool { return x != y })
+}
+
+func compare(a, b interface{}, op string, cmp func(x, y float64) bool) interface{} {
+	switch a.(type) {
+	case float32, float64:
+		switch b.(type) {
+		case float32, float64:
+			return cmp(scalarFloat64(a), scalarFloat64(b))
+		case []float32, []float64:
+			return compareVec(repeatFloat64(scalarFloat64(a), lenVec(b)), vecFloat64(b), op, cmp)
+		}
+	case []float32, []float64:
+		switch b.(type) {
+		case float32, float64:
+			return compareVec(vecFloat64(a), repeatFloat64(scalarFloat64(b), lenVec(a)), op, cmp)
+		case []float32, []float64:
+			return compareVec(vecFloat64(a), vecFloat64(b), op, cmp)
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T %v %T", a, op, b))
+}
+
+func compareVec(a, b []float64, op string, cmp func(x, y float64) bool) []bool {
+	if len(a) != len(b) {
+		panic(fmt.Sprintf("invalid operation: mismatched lengths %d %v %d", len(a), op, len(b)))
+	}
+	out := make([]bool, len(a))
+	for j := range a {
+		out[j] = cmp(a[j], b[j])
+	}
+	return out
+}
+
+func scalarFloat64(a interface{}) float64 {
+	switch x := a.(type) {
+	case float32:
+		return float64(x)
+	case float64:
+		return x
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "cast float64", a))
+}
+
+func vecFloat64(a interface{}) []float64 {
+	switch x := a.(type) {
+	case []float32:
+		return castFloat64(x)
+	case []float64:
+		return x
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "cast float64", a))
+}
@@ -0,0 +1,50 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompareScalars(t *testing.T) {
+	assert.Equal(t, true, less(1.0, 2.0))
+	assert.Equal(t, false, less(2.0, 2.0))
+	assert.Equal(t, true, lessEqual(float32(2.0), 2.0))
+	assert.Equal(t, false, greater(1.0, float32(2.0)))
+	assert.Equal(t, true, greaterEqual(float32(2.0), float32(2.0)))
+	assert.Equal(t, true, equal(2.0, 2.0))
+	assert.Equal(t, false, notEqual(2.0, 2.0))
+}
+
+func TestCompareScalarVector(t *testing.T) {
+	X := []float64{-1.0, 0.5, 2.0}
+	assert.Equal(t, []bool{false, false, true}, greater(X, 0.5))
+	assert.Equal(t, []bool{false, true, true}, greaterEqual(X, float32(0.5)))
+	assert.Equal(t, []bool{true, false, false}, greater(0.5, X))
+	assert.Equal(t, []bool{true, true, false}, lessEqual([]float32{-1.0, 0.5, 2.0}, 0.5))
+}
+
+func TestCompareVectors(t *testing.T) {
+	X := []float64{-1.0, 0.5, 2.0}
+	Y := []float32{-1.0, 1.0, 1.0}
+	assert.Equal(t, []bool{true, false, false}, equal(X, Y))
+	assert.Equal(t, []bool{false, true, true}, notEqual(X, Y))
+	assert.Equal(t, []bool{false, true, false}, less(X, Y))
+}
+
+func TestCompareWrongType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	less("foo", 1.0)
+}
+
+func TestCompareLengthMismatch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	less([]float64{1.0, 2.0}, []float64{1.0})
+}
@@ -0,0 +1,157 @@
+package ast
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FuncDef is a function written in the expression language, such as
+// def zscore(v) = (v - nanmean(v)) / nanstd(v).
+//
+// The body of a function sees its parameters and the variables of the
+// environment, but not the local variables of the program calling it. Calls
+// in the body are bound when the definition is parsed: a function cannot call
+// itself, and redefining a function does not change the functions that were
+// defined with the previous definition.
+type FuncDef struct {
+	Name   string
+	Params []string
+	body   *AST
+}
+
+var (
+	defsMu sync.RWMutex
+	defs   = make(map[string]*FuncDef)
+)
+
+// ParseDef parses a function definition. The leading def keyword is
+// optional, e.g. "zscore(v) = (v - nanmean(v)) / nanstd(v)".
+func ParseDef(source string) (*FuncDef, error) {
+	p := &parser{source: source}
+	tokens, errs := tokenize(source, 0)
+	p.errors = errs
+	if len(p.errors) == 0 {
+		if len(tokens) == 0 || !isDefKeyword(tokens[0]) {
+			tokens = append([]Token{{typ: name, val: "def"}}, tokens...)
+		}
+		def := p.parseDef(tokens, nil)
+		if len(p.errors) == 0 {
+			return def, nil
+		}
+	}
+	first := p.errors[:1]
+	first.locate()
+	return nil, first[0]
+}
+
+// Define makes def callable from the expressions parsed afterwards,
+// replacing any previous definition with the same name.
+func Define(def *FuncDef) {
+	defsMu.Lock()
+	defer defsMu.Unlock()
+	defs[def.Name] = def
+}
+
+// Undefine removes the function name defined with Define.
+func Undefine(name string) {
+	defsMu.Lock()
+	defer defsMu.Unlock()
+	delete(defs, name)
+}
+
+func lookupDef(name string) *FuncDef {
+	defsMu.RLock()
+	defer defsMu.RUnlock()
+	return defs[name]
+}
+
+// isDefKeyword reports whether token starts a function definition.
+func isDefKeyword(token Token) bool {
+	return token.typ == name && !token.quoted && token.val == "def"
+}
+
+// parseDef parses the statement def name(param, ...) = body. Names bound by
+// the program so far are listed in locals, so that the body cannot use them.
+func (p *parser) parseDef(statement []Token, locals map[string]bool) *FuncDef {
+	n := len(statement)
+	at := func(i int) Token {
+		if i < n {
+			return statement[i]
+		}
+		return statement[n-1]
+	}
+	fnName := at(1)
+	if n >= 2 && fnName.typ == number && isConstant(fnName.val) {
+		p.fail(fnName, fmt.Sprintf("cannot redefine constant '%s'", fnName.val))
+		return nil
+	}
+	if n < 2 || !(isPlainName(fnName) || fnName.typ == function) {
+		p.fail(fnName, "missing function name after 'def'", "name")
+		return nil
+	}
+	if isBuiltin(fnName.val) {
+		p.fail(fnName, fmt.Sprintf("cannot redefine builtin function '%s'", fnName.val))
+		return nil
+	}
+	if n < 3 || statement[2].typ != lparen {
+		p.fail(at(2), fmt.Sprintf("missing '(' after function '%s'", fnName.val), "'('")
+		return nil
+	}
+	def := &FuncDef{Name: fnName.val}
+	params := make(map[string]bool)
+	i := 3
+	if i < n && statement[i].typ == rparen {
+		i++
+	} else {
+		for {
+			// a parameter hides the constant of the same name
+			if i < n && statement[i].typ == number && isConstant(statement[i].val) {
+				statement[i].typ = name
+			}
+			if i >= n || !isPlainName(statement[i]) {
+				p.fail(at(i), "missing parameter name", "name")
+				return nil
+			}
+			param := statement[i].val
+			if params[param] {
+				p.fail(statement[i], fmt.Sprintf("duplicate parameter '%s'", param))
+				return nil
+			}
+			params[param] = true
+			def.Params = append(def.Params, param)
+			i++
+			if i < n && statement[i].typ == comma {
+				i++
+				continue
+			}
+			if i < n && statement[i].typ == rparen {
+				i++
+				break
+			}
+			p.fail(at(i), "missing ')' after parameters", "','", "')'")
+			return nil
+		}
+	}
+	if i >= n || statement[i].typ != assign {
+		p.fail(at(i), fmt.Sprintf("missing '=' after the parameters of function '%s'", def.Name), "'='")
+		return nil
+	}
+	body := statement[i+1:]
+	if len(body) == 0 {
+		p.fail(statement[i], fmt.Sprintf("missing body of function '%s'", def.Name), "expression")
+		return nil
+	}
+	shadowConstants(body, params)
+	for j, token := range body {
+		if (token.typ != name && token.typ != function) || token.quoted || params[token.val] {
+			continue
+		}
+		if token.val == def.Name && j+1 < len(body) && body[j+1].typ == lparen {
+			p.fail(token, fmt.Sprintf("function '%s' cannot call itself", def.Name))
+		} else if locals[token.val] {
+			p.fail(token, fmt.Sprintf("local variable '%s' cannot be used in function '%s'", token.val, def.Name))
+		}
+	}
+	def.body = p.parseExpr(body)
+	return def
+}
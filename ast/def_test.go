@@ -0,0 +1,123 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseDef(t *testing.T) {
+	for _, source := range []string{
+		"def zscore(v) = (v - nanmean(v)) / nanstd(v)",
+		"zscore(v) = (v - nanmean(v)) / nanstd(v)",
+	} {
+		def, err := ParseDef(source)
+		require.NoError(t, err, source)
+		assert.Equal(t, "zscore", def.Name)
+		assert.Equal(t, []string{"v"}, def.Params)
+	}
+}
+
+func TestParseDefErrors(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{"", "missing function name after 'def' at position 0"},
+		{"def sum(v) = v", "cannot redefine builtin function 'sum' at position 4"},
+		{"def pi(v) = v", "cannot redefine constant 'pi' at position 4"},
+		{"def f v = v", "missing '(' after function 'f' at position 6"},
+		{"def f(v, ) = v", "missing parameter name at position 9"},
+		{"def f(v w) = v", "missing ')' after parameters at position 8"},
+		{"def f(v, v) = v", "duplicate parameter 'v' at position 9"},
+		{"def f(v) v", "missing '=' after the parameters of function 'f' at position 9"},
+		{"def f(v) =", "missing body of function 'f' at position 9"},
+		{"def f(v) = f(v - 1)", "function 'f' cannot call itself at position 11"},
+		{"def f(v) = v; 1", "unexpected ';' at position 12"},
+		{"def f(v) = g(v)", "unknown function 'g' at position 11"},
+	}
+	for _, test := range tests {
+		def, err := ParseDef(test.source)
+		assert.Nil(t, def, test.source)
+		require.Error(t, err, test.source)
+		assert.Equal(t, test.expected, err.Error(), test.source)
+	}
+}
+
+func TestDefine(t *testing.T) {
+	def, err := ParseDef("def testclip01(v) = min(max(v, 0), 1)")
+	require.NoError(t, err)
+	Define(def)
+	defer Undefine("testclip01")
+
+	ast, err := ParseExpr("testclip01(X * 2)")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.0, 1.0, 1.0}, Evaluate(ast, &Env{"X": []float64{-1.0, 0.5, 2.0}}))
+
+	_, err = ParseExpr("testclip01(X, 2)")
+	assert.EqualError(t, err, "function 'testclip01' expects 1 argument, got 2 at position 0")
+
+	// calls are bound when parsed, so redefining does not affect them
+	redef, err := ParseDef("def testclip01(v) = v")
+	require.NoError(t, err)
+	Define(redef)
+	assert.Equal(t, 1.0, Evaluate(ast, &Env{"X": 3.0}))
+
+	// the name of a defined function still reads as a variable
+	ast, err = ParseExpr("testclip01 + 1")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, Evaluate(ast, &Env{"testclip01": 1.0}))
+	ast, err = ParseExpr("def f(testclip01) = testclip01 * 2; f(3)")
+	require.NoError(t, err)
+	assert.Equal(t, 6.0, Evaluate(ast, nil))
+
+	// a program can hide a defined function, but not after calling it
+	ast, err = ParseExpr("def testclip01(v) = v * 2; testclip01(3)")
+	require.NoError(t, err)
+	assert.Equal(t, 6.0, Evaluate(ast, nil))
+	_, err = ParseExpr("a = testclip01(3); def testclip01(v) = v * 2; a + testclip01(3)")
+	assert.EqualError(t, err, "function 'testclip01' is defined after it is called at position 23")
+	_, err = ParseExpr("def g(v) = testclip01(v); def testclip01(v) = v * 2; g(3)")
+	assert.EqualError(t, err, "function 'testclip01' is defined after it is called at position 30")
+
+	Undefine("testclip01")
+	_, err = ParseExpr("testclip01(X)")
+	assert.EqualError(t, err, "unknown function 'testclip01' at position 0")
+}
+
+func TestDefineRedefinitionIsNotRecursive(t *testing.T) {
+	f, err := ParseDef("def testf(x) = x + 1")
+	require.NoError(t, err)
+	Define(f)
+	defer Undefine("testf")
+	g, err := ParseDef("def testg(x) = testf(x) * 2")
+	require.NoError(t, err)
+	Define(g)
+	defer Undefine("testg")
+	f, err = ParseDef("def testf(x) = testg(x)")
+	require.NoError(t, err)
+	Define(f)
+
+	ast, err := ParseExpr("testf(1)")
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, Evaluate(ast, nil))
+}
+
+func TestParseProgramDefs(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"def f(x) = x; f(1, 2)", "function 'f' expects 1 argument, got 2 at position 14"},
+		{"lo = 1; def f(x) = x + lo; f(1)", "local variable 'lo' cannot be used in function 'f' at position 23"},
+		{"def f(x) = 1", "missing result expression after the definition of 'f' at position 4"},
+		{"y = f(1); def f(x) = x; y", "unknown function 'f' at position 4"},
+		{"def f(x) = x; def g(y) = f(y); def f(x) = 2*x; f(1) + g(1)", "function 'f' is already defined at position 35"},
+		{"def f(x) = x; a = f(1); def f(x) = 10*x; a + f(1)", "function 'f' is already defined at position 28"},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.expr)
+		require.Error(t, err, test.expr)
+		assert.Equal(t, test.expected, err.Error(), test.expr)
+	}
+}
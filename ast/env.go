@@ -1,5 +1,11 @@
 package ast
 
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
 type Env map[string]interface{}
 
 func NewEnv() *Env {
@@ -9,3 +15,74 @@ func NewEnv() *Env {
 func (e *Env) Set(key string, value interface{}) {
 	(*e)[key] = value
 }
+
+// lookup returns the value of the variable name. A dotted name such as
+// host.cpu.user that is not a key of the environment is resolved one segment
+// at a time through nested maps with string keys, such as Env and
+// map[string]interface{}, and through the exported fields of structs.
+func (e *Env) lookup(name string) interface{} {
+	if e == nil {
+		panic(fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", name))
+	}
+	if value, ok := (*e)[name]; ok {
+		return value
+	}
+	segments := strings.Split(name, ".")
+	value, ok := (*e)[segments[0]]
+	if !ok {
+		panic(fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", name))
+	}
+	for i, segment := range segments[1:] {
+		value, ok = member(value, segment)
+		if !ok {
+			parent := strings.Join(segments[:i+1], ".")
+			panic(fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment: '%s' has no member '%s'", name, parent, segment))
+		}
+	}
+	return value
+}
+
+// key returns the value stored under name, without resolving dotted names.
+// It is used for quoted identifiers, which name environment keys verbatim.
+func (e *Env) key(name string) interface{} {
+	if e != nil {
+		if value, ok := (*e)[name]; ok {
+			return value
+		}
+	}
+	panic(fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", name))
+}
+
+// member returns the value stored under key in a map with string keys, or
+// the exported struct field named key, following pointers.
+func member(value interface{}, key string) (interface{}, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		m := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if !m.IsValid() {
+			return nil, false
+		}
+		return m.Interface(), true
+	case reflect.Struct:
+		f, ok := v.Type().FieldByName(key)
+		if !ok || !f.IsExported() {
+			return nil, false
+		}
+		field, err := v.FieldByIndexErr(f.Index)
+		if err != nil {
+			return nil, false
+		}
+		return field.Interface(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,63 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type cpuStats struct {
+	User   []float64
+	System float64
+	idle   float64
+}
+
+type hostStats struct {
+	Name string
+	CPU  *cpuStats
+}
+
+func TestEnvLookupNested(t *testing.T) {
+	env := &Env{
+		"host": map[string]interface{}{
+			"cpu": Env{"user": []float64{1, 2}},
+		},
+		"sensor":     &Env{"temp": 21.5},
+		"server":     hostStats{CPU: &cpuStats{User: []float64{3, 4}, System: 0.5}},
+		"flat.key":   2.0,
+		"flat":       map[string]float64{"key": 3.0},
+		"thresholds": map[string]float32{"high": 90},
+	}
+	assert.Equal(t, []float64{1, 2}, env.lookup("host.cpu.user"))
+	assert.Equal(t, 21.5, env.lookup("sensor.temp"))
+	assert.Equal(t, []float64{3, 4}, env.lookup("server.CPU.User"))
+	assert.Equal(t, 0.5, env.lookup("server.CPU.System"))
+	assert.Equal(t, 2.0, env.lookup("flat.key"))
+	assert.Equal(t, float32(90), env.lookup("thresholds.high"))
+}
+
+func TestEnvLookupMissing(t *testing.T) {
+	env := &Env{
+		"host":   map[string]interface{}{"cpu": Env{"user": 1.0}},
+		"server": hostStats{},
+		"count":  3.0,
+	}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"disk.free", "Cannot evaluate expression. Key 'disk.free' not found in environment"},
+		{"host.cpu.idle", "Cannot evaluate expression. Key 'host.cpu.idle' not found in environment: 'host.cpu' has no member 'idle'"},
+		{"host.mem.free", "Cannot evaluate expression. Key 'host.mem.free' not found in environment: 'host' has no member 'mem'"},
+		{"server.CPU.User", "Cannot evaluate expression. Key 'server.CPU.User' not found in environment: 'server.CPU' has no member 'User'"},
+		{"server.cpu", "Cannot evaluate expression. Key 'server.cpu' not found in environment: 'server' has no member 'cpu'"},
+		{"count.value", "Cannot evaluate expression. Key 'count.value' not found in environment: 'count' has no member 'value'"},
+	}
+	for _, test := range tests {
+		assert.PanicsWithValue(t, test.expected, func() { env.lookup(test.name) }, test.name)
+	}
+}
+
+func TestEnvLookupUnexportedField(t *testing.T) {
+	env := &Env{"cpu": cpuStats{idle: 1}}
+	assert.Panics(t, func() { env.lookup("cpu.idle") })
+}
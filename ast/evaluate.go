@@ -2,25 +2,42 @@ package ast
 
 import (
 	"fmt"
-	"strconv"
 )
 
 func Evaluate(node *AST, env *Env) interface{} {
+	return evaluate(node, env, nil)
+}
+
+// scope holds the let bindings visible to an expression, innermost first.
+type scope struct {
+	name   string
+	value  interface{}
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (interface{}, bool) {
+	for ; s != nil; s = s.parent {
+		if s.name == name {
+			return s.value, true
+		}
+	}
+	return nil, false
+}
+
+func evaluate(node *AST, env *Env, sc *scope) interface{} {
 	if node == nil {
 		return nil
 	}
 	if node.token.typ == number {
-		value, _ := strconv.ParseFloat(node.token.val, 64)
-		return value
+		return numberValue(node.token.val)
 	} else if node.token.typ == name {
-		if env == nil {
-			errorString := fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", node.token.val)
-			panic(errorString)
-		}
-		value, ok := (*env)[node.token.val]
-		if !ok {
-			errorString := fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", node.token.val)
-			panic(errorString)
+		var value interface{}
+		if node.token.quoted {
+			value = env.key(node.token.val)
+		} else if bound, ok := sc.lookup(node.token.val); ok {
+			value = bound
+		} else {
+			value = env.lookup(node.token.val)
 		}
 		if _, ok := value.(float64); ok {
 			return value.(float64)
@@ -34,30 +51,62 @@ func Evaluate(node *AST, env *Env) interface{} {
 		if _, ok := value.([]float32); ok {
 			return value.([]float32)
 		}
+		if _, ok := value.(bool); ok {
+			return value.(bool)
+		}
+		if _, ok := value.([]bool); ok {
+			return value.([]bool)
+		}
+		if _, ok := value.(int); ok {
+			return value.(int)
+		}
+		if _, ok := value.([]int); ok {
+			return value.([]int)
+		}
 		errorString := fmt.Sprintf("Unsupported data type '%T' for token '%v'", value, node.token.val)
 		panic(errorString)
+	} else if node.token.typ == let {
+		value := evaluate(node.left, env, sc)
+		return evaluate(node.right, env, &scope{name: node.token.val, value: value, parent: sc})
 	} else if node.token.typ == slice {
-		if env == nil {
-			errorString := fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", node.token.val)
-			panic(errorString)
-		}
-		value, ok := (*env)[node.token.varName]
-		if !ok {
-			errorString := fmt.Sprintf("Cannot evaluate expression. Key '%s' not found in environment", node.token.varName)
-			panic(errorString)
+		value := evaluate(node.left, env, sc)
+		bounds := newSliceBounds(evaluate(node.args[0], env, sc), evaluate(node.args[1], env, sc), evaluate(node.args[2], env, sc))
+		return sliceVec(value, bounds, indexLabel(node.left))
+	} else if node.token.typ == index {
+		value := evaluate(node.left, env, sc)
+		return indexVec(value, evaluate(node.right, env, sc), indexLabel(node.left))
+	}
+
+	if node.token.typ == unary {
+		operand := evaluate(node.right, env, sc)
+		switch node.token.val {
+		case "-":
+			return negate(operand)
+		case "+":
+			return identity(operand)
+		case "not":
+			return logicalNot(operand)
 		}
-		if _, ok := value.([]float64); ok {
-			return value.([]float64)[node.token.varIdx]
+	}
+
+	if node.token.typ == function {
+		args := make([]interface{}, len(node.args))
+		for i, arg := range node.args {
+			args[i] = evaluate(arg, env, sc)
 		}
-		if _, ok := value.([]float32); ok {
-			return value.([]float32)[node.token.varIdx]
+		if def := node.token.def; def != nil {
+			// the body only sees the parameters, not the caller's bindings
+			var params *scope
+			for i, param := range def.Params {
+				params = &scope{name: param, value: args[i], parent: params}
+			}
+			return evaluate(def.body, env, params)
 		}
-		errorString := fmt.Sprintf("Unsupported data type '%T' for token '%v'", value, node.token.varName)
-		panic(errorString)
+		return callFunction(node.token.fn, args)
 	}
 
-	left := Evaluate(node.left, env)
-	right := Evaluate(node.right, env)
+	left := evaluate(node.left, env, sc)
+	right := evaluate(node.right, env, sc)
 
 	switch node.token.val {
 	case "+":
@@ -68,123 +117,24 @@ func Evaluate(node *AST, env *Env) interface{} {
 		return multiply(left, right)
 	case "/":
 		return divide(left, right)
-	case ",":
-		return concat(left, right)
-	case "sum":
-		return sum(right)
-	case "abs":
-		return abs(right)
-	case "acos":
-		return acos(right)
-	case "acosh":
-		return acosh(right)
-	case "asin":
-		return asin(right)
-	case "asinh":
-		return asinh(right)
-	case "atan":
-		return atan(right)
-	case "atanh":
-		return atanh(right)
-	case "cbrt":
-		return cbrt(right)
-	case "ceil":
-		return ceil(right)
-	case "cos":
-		return cos(right)
-	case "cosh":
-		return cosh(right)
-	case "erf":
-		return erf(right)
-	case "erfc":
-		return erfc(right)
-	case "erfcinv":
-		return erfcinv(right)
-	case "erfinv":
-		return erfinv(right)
-	case "exp":
-		return exp(right)
-	case "exp2":
-		return exp2(right)
-	case "expm1":
-		return expm1(right)
-	case "floor":
-		return floor(right)
-	case "gamma":
-		return gamma(right)
-	case "j0":
-		return j0(right)
-	case "j1":
-		return j1(right)
-	case "log":
-		return log(right)
-	case "log10":
-		return log10(right)
-	case "log1p":
-		return log1p(right)
-	case "log2":
-		return log2(right)
-	case "logb":
-		return logb(right)
-	case "round":
-		return round(right)
-	case "roundtoeven":
-		return roundtoeven(right)
-	case "sin":
-		return sin(right)
-	case "sinh":
-		return sinh(right)
-	case "sqrt":
-		return sqrt(right)
-	case "tan":
-		return tan(right)
-	case "tanh":
-		return tanh(right)
-	case "trunc":
-		return trunc(right)
-	case "y0":
-		return y0(right)
-	case "y1":
-		return y1(right)
-	case "add":
-		args := right.(Args)
-		return add(args[0], args[1])
-	case "sub":
-		args := right.(Args)
-		return subtract(args[0], args[1])
-	case "mul":
-		args := right.(Args)
-		return multiply(args[0], args[1])
-	case "div":
-		args := right.(Args)
-		return divide(args[0], args[1])
-	case "min":
-		args := right.(Args)
-		return min(args[0], args[1])
-	case "max":
-		args := right.(Args)
-		return max(args[0], args[1])
-	case "mod":
-		args := right.(Args)
-		return mod(args[0], args[1])
-	case "pow":
-		args := right.(Args)
-		return pow(args[0], args[1])
-	case "remainder":
-		args := right.(Args)
-		return remainder(args[0], args[1])
-	case "nanmin":
-		return nanmin(right)
-	case "nanmax":
-		return nanmax(right)
-	case "nanmean":
-		return nanmean(right)
-	case "nanstd":
-		return nanstd(right)
-	case "nansum":
-		return nansum(right)
-	case "nanprod":
-		return nanprod(right)
+	case "^", "**":
+		return pow(left, right)
+	case "<":
+		return less(left, right)
+	case "<=":
+		return lessEqual(left, right)
+	case ">":
+		return greater(left, right)
+	case ">=":
+		return greaterEqual(left, right)
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return notEqual(left, right)
+	case "and":
+		return logicalAnd(left, right)
+	case "or":
+		return logicalOr(left, right)
 	}
 	return 0
 }
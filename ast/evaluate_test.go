@@ -3,6 +3,7 @@ package ast
 import (
 	"math"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -25,6 +26,11 @@ func TestEvaluate(t *testing.T) {
 		{"2 * 3 + 4 * 5", 26},
 		{"2 * (3 + 4.0) * 5", 70},
 		{"2.21 * (3.07 + 4) * 5.001", 78.1391247},
+		{"1e-3 * 2", 0.002},
+		{"2.5E+2 - 1e2", 150},
+		{"6.02e23 / 6.02E23", 1},
+		{".5 + 5.", 5.5},
+		{"aa-1e1", -5},
 	}
 
 	for _, test := range tests {
@@ -91,6 +97,204 @@ func TestEvaluateVectorOps(t *testing.T) {
 	}
 }
 
+func TestEvaluateUnary(t *testing.T) {
+	vars := &Env{
+		"X": 2.0,
+		"Y": float32(4.0),
+	}
+	tests := []struct {
+		expr     string
+		expected float64
+	}{
+		{"-X", -2},
+		{"+X", 2},
+		{"-3 + 5", 2},
+		{"2 * -X", -4},
+		{"-X * 3", -6},
+		{"- -X", 2},
+		{"1 - -X", 3},
+		{"-(1 + X)", -3},
+		{"exp(-X)", math.Exp(-2)},
+		{"-exp(X)", -math.Exp(2)},
+		{"-Y / 2", -2},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		var result float64
+		switch x := Evaluate(ast, vars).(type) {
+		case float64:
+			result = x
+		case float32:
+			result = float64(x)
+		default:
+			t.Fatalf("For expression %s, unexpected output type %T", test.expr, x)
+		}
+		if math.Abs(result-test.expected) > 1e-9 {
+			t.Errorf("For expression %s, expected %f but got %f", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateUnaryVector(t *testing.T) {
+	ast, _ := ParseExpr(`2 * -X + -Y`)
+	vars := &Env{
+		"X": []float64{-1.0, 3.0, -2.0},
+		"Y": []float32{1.0, 1.0, 1.0},
+	}
+	expected := []float64{1.0, -7.0, 3.0}
+	result := Evaluate(ast, vars)
+	checkFloat64SlicesEqual(t, result.([]float64), expected)
+
+	ast, _ = ParseExpr(`-Y`)
+	result = Evaluate(ast, vars)
+	checkFloat32SlicesEqual(t, result.([]float32), []float32{-1.0, -1.0, -1.0})
+}
+
+func TestEvaluatePower(t *testing.T) {
+	vars := &Env{
+		"X": 3.0,
+	}
+	tests := []struct {
+		expr     string
+		expected float64
+	}{
+		{"2 ^ 3", 8},
+		{"2 ** 3", 8},
+		{"2 ^ 3 ^ 2", 512},
+		{"2 ** 3 ** 2", 512},
+		{"(2 ^ 3) ^ 2", 64},
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"2 ^ -1", 0.5},
+		{"2 * 3 ^ 2", 18},
+		{"3 ^ 2 / 3", 3},
+		{"X ^ 2 + 1", 10},
+		{"2 ^ -X * 8", 1},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if math.Abs(result.(float64)-test.expected) > 1e-9 {
+			t.Errorf("For expression %s, expected %f but got %f", test.expr, test.expected, result.(float64))
+		}
+	}
+}
+
+func TestEvaluatePowerVector(t *testing.T) {
+	ast, _ := ParseExpr(`X ^ 2 + 2 ** Y`)
+	vars := &Env{
+		"X": []float64{-1.0, 3.0, -2.0},
+		"Y": []float32{0.0, 1.0, 2.0},
+	}
+	expected := []float64{2.0, 11.0, 8.0}
+	result := Evaluate(ast, vars)
+	checkFloat64SlicesEqual(t, result.([]float64), expected)
+}
+
+func TestEvaluateComparison(t *testing.T) {
+	vars := &Env{
+		"Temp":      21.5,
+		"Threshold": float32(20.0),
+	}
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{"1 < 2", true},
+		{"2 <= 2", true},
+		{"1 > 2", false},
+		{"2 >= 3", false},
+		{"2 == 2", true},
+		{"2 != 2", false},
+		{"Temp <= Threshold", false},
+		{"Temp > Threshold + 1", true},
+		{"Temp - 1.5 == Threshold", true},
+		{"-Temp < -Threshold", true},
+		{"2 * 3 >= 2 ^ 3", false},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if result != test.expected {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateComparisonVector(t *testing.T) {
+	vars := &Env{
+		"X": []float64{0.1, 0.5, 0.9},
+		"Y": []float32{0.2, 0.5, 0.2},
+	}
+	tests := []struct {
+		expr     string
+		expected []bool
+	}{
+		{"X > 0.5", []bool{false, false, true}},
+		{"0.5 >= X", []bool{true, true, false}},
+		{"X != Y", []bool{true, false, true}},
+		{"X < Y * 2", []bool{true, true, false}},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateLogical(t *testing.T) {
+	vars := &Env{
+		"X": []float64{-1.0, 2.0, math.NaN(), 12.0, 5.0},
+		"Y": []float64{1.0, 3.0, 1.0, 1.0, 20.0},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"(X > 0) and (Y < 10)", []bool{false, true, false, true, false}},
+		{"X > 0 and Y < 10", []bool{false, true, false, true, false}},
+		{"X < 0 or X > 10", []bool{true, false, false, true, false}},
+		{"not isnan(X)", []bool{true, true, false, true, true}},
+		{"not X > 0 and Y < 10", []bool{true, false, true, false, false}},
+		{"X > 0 or Y > 0 and X < 0", []bool{true, true, false, true, true}},
+		{"any(X > 10)", true},
+		{"all(Y > 0)", true},
+		{"all(X > 0)", false},
+		{"count(isnan(X))", 1.0},
+		{"count(Y > 2 * nanstd(Y)) + 1", 2.0},
+		{"1 < 2 and 2 < 1", false},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
 func TestEvaluateAbs(t *testing.T) {
 	ast, _ := ParseExpr(`abs(X)`)
 	vars := &Env{
@@ -517,6 +721,341 @@ func TestEvaluateMax(t *testing.T) {
 	checkFloat64SlicesEqual(t, result.([]float64), expected)
 }
 
+func TestEvaluateWhere(t *testing.T) {
+	vars := &Env{
+		"X":    []float64{-1.0, 3.0, math.NaN()},
+		"Y":    []float32{1.0, 2.0, 3.0},
+		"Temp": float32(15.0),
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"where(X > 0, X, 0)", []float64{0.0, 3.0, 0.0}},
+		{"where(isnan(X), nanmean(X), X)", []float64{-1.0, 3.0, 1.0}},
+		{"where(X < 0, -X, Y * 2)", []float64{1.0, 4.0, 6.0}},
+		{"where(Y >= 2, Y, Temp)", []float32{15.0, 2.0, 3.0}},
+		{"where(Temp > 10, 1, 2) + 1", 2.0},
+		{"add(where(Temp > 20, X, Y), 1)", []float64{2.0, 3.0, 4.0}},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateSlice(t *testing.T) {
+	vars := &Env{
+		"X": []float64{1.0, 2.0, 3.0, 4.0, 5.0, 6.0},
+		"Y": []float32{1.0, 2.0, 3.0},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"X[-1]", 6.0},
+		{"X[2:4]", []float64{3.0, 4.0}},
+		{"X[::2]", []float64{1.0, 3.0, 5.0}},
+		{"X[-2:] * 2", []float64{10.0, 12.0}},
+		{"X[::-1]", []float64{6.0, 5.0, 4.0, 3.0, 2.0, 1.0}},
+		{"nanmean(X[-3:])", 5.0},
+		{"Y[-1] + Y[0]", float32(4.0)},
+		{"Y[1:]", []float32{2.0, 3.0}},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateIndexExpression(t *testing.T) {
+	vars := &Env{
+		"X": []float64{-1.0, 2.0, -3.0, 4.0},
+		"Y": []float32{1.0, 2.0, 3.0},
+		"i": 2.0,
+		"n": float32(1.0),
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"(X * 2)[0]", -2.0},
+		{"abs(X)[-1]", 4.0},
+		{"-X[2]", 3.0},
+		{"2 ^ X[1]", 4.0},
+		{"X[i]", -3.0},
+		{"X[i - 1] + X[-i]", -1.0},
+		{"Y[n]", float32(2.0)},
+		{"X[n:i + 1]", []float64{2.0, -3.0}},
+		{"X[::-i]", []float64{4.0, 2.0}},
+		{"X[1:][0]", 2.0},
+		{"nanmax(abs(X)[:3])", 3.0},
+		{"X[Y[0]]", 2.0},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateFancyIndex(t *testing.T) {
+	vars := &Env{
+		"X":   []float64{-1.0, 2.0, -3.0, 4.0},
+		"Y":   []float32{1.0, 2.0, 3.0, 4.0},
+		"idx": []int{3, 0},
+		"pos": []float64{1.0, -1.0},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"X[X > 0]", []float64{2.0, 4.0}},
+		{"nanmean(X[X > 0])", 3.0},
+		{"Y[X < 0 and Y > 1]", []float32{3.0}},
+		{"X[idx]", []float64{4.0, -1.0}},
+		{"Y[pos] * 2", []float64{4.0, 8.0}},
+		{"count(X[idx] > 0)", 1.0},
+		{"X[not isnan(X)][idx]", []float64{4.0, -1.0}},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateIndexNotInteger(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	vars := &Env{
+		"X": []float64{-1.0, 2.0, -3.0, 4.0},
+	}
+	ast, _ := ParseExpr("X[1 / 2]")
+	Evaluate(ast, vars)
+}
+
+func TestEvaluateFunctionArguments(t *testing.T) {
+	vars := &Env{
+		"X":   []float64{-1.0, 3.0, -2.0},
+		"X32": []float32{-1.0, 3.0, -2.0},
+		"Y32": []float32{0.0, -1.0, 1.0},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"add(2, X)", []float64{1.0, 5.0, 0.0}},
+		{"add(2, 3) * 2", 10.0},
+		{"max(X32, Y32)", []float32{0.0, 3.0, 1.0}},
+		{"max(X, 0, -X32)", []float64{1.0, 3.0, 2.0}},
+		{"min(1, 2, -3, 4)", -3.0},
+		{"pow(add(1, 1), sub(4, 1))", 8.0},
+		{"add(1 + 2, mul(X, X)[1])", 12.0},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateDottedNames(t *testing.T) {
+	vars := &Env{
+		"host":   Env{"cpu": map[string]interface{}{"user": []float64{10.0, 20.0}, "system": 5.0}},
+		"sensor": struct{ Temp float32 }{Temp: 21.5},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"host.cpu.user + host.cpu.system", []float64{15.0, 25.0}},
+		{"host.cpu.user[-1]", 20.0},
+		{"sensor.Temp < 30", true},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateQuotedNames(t *testing.T) {
+	vars := &Env{
+		"cpu load":      []float64{0.5, 1.5},
+		"node:mem-free": 2.0,
+		"sum":           1.0,
+		"host.cpu":      3.0,
+		"host":          Env{"cpu": 4.0},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{`"cpu load" * "node:mem-free"`, []float64{1.0, 3.0}},
+		{`sum("cpu load") + "sum"`, 3.0},
+		{`"host.cpu"`, 3.0},
+		{`host.cpu`, 3.0},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateQuotedNameNotResolved(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	vars := &Env{
+		"host": Env{"cpu": 4.0},
+	}
+	ast, _ := ParseExpr(`"host.cpu"`)
+	Evaluate(ast, vars)
+}
+
+func TestEvaluateLet(t *testing.T) {
+	vars := &Env{
+		"X":  []float64{2.0, 4.0, 6.0},
+		"lo": 100.0,
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"lo = nanmin(X); hi = nanmax(X); (X - lo) / (hi - lo)", []float64{0.0, 0.5, 1.0}},
+		{"lo", 100.0},
+		{`lo = 1; lo + "lo"`, 101.0},
+		{"x = 1; x = x + 1; x * 10", 20.0},
+		{"m = X > 3; count(m) + sum(X[m])", 12.0},
+		{"n = 2; X[n:]", []float64{6.0}},
+		{"# min-max scaling\nlo = nanmin(X); // lowest\nhi = nanmax(X);\n\t(X - lo) / (hi - lo)\n", []float64{0.0, 0.5, 1.0}},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateConstants(t *testing.T) {
+	vars := &Env{
+		"X":  []float64{1.0, math.NaN()},
+		"F":  0.5,
+		"pi": 3.0,
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"2 * pi * F", math.Pi},
+		{"tau / 2 - pi", 0.0},
+		{"log(e)", 1.0},
+		{"where(isnan(X), -inf, X)", []float64{1.0, math.Inf(-1)}},
+		{"count(isnan(where(X > 0, nan, X)))", 2.0},
+		{`"pi" + pi`, 3.0 + math.Pi},
+		{"pi = 3; pi * 2", 6.0},
+		{"def area(r, pi) = pi * r ^ 2; area(2, 3)", 12.0},
+		{"def area(r) = pi * r ^ 2; pi = 3; area(1)", math.Pi},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestEvaluateDef(t *testing.T) {
+	vars := &Env{
+		"X": []float64{1.0, 2.0, 3.0},
+		"k": 10.0,
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"def zscore(v) = (v - nanmean(v)) / nanstd(v); zscore(X)", []float64{-1.0, 0.0, 1.0}},
+		{"def clip01(v) = min(max(v, 0), 1); def scale(v, s) = clip01(v * s); scale(X, 0.4)", []float64{0.4, 0.8, 1.0}},
+		{"def ten() = 10; ten() * 2", 20.0},
+		{"def addk(x) = x + k; addk(1)", 11.0},
+		{"def sq(x) = x * x; x = 3; sq(x + 1) + x", 19.0},
+		{"def = 3; def * 2", 6.0},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("For expression %s, got error %v", test.expr, err)
+		}
+		result := Evaluate(ast, vars)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("For expression %s, expected %v but got %v", test.expr, test.expected, result)
+		}
+	}
+}
+
 func TestEvaluateNoEnv(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -554,6 +1093,23 @@ func TestEvaluateStaticTypes(t *testing.T) {
 	Evaluate(ast, vars)
 }
 
+func TestEvaluateArgumentType(t *testing.T) {
+	expected := "function 'nanmean' expects vector for argument 1, got float64"
+	defer func() {
+		if r := recover(); r != expected {
+			t.Errorf("Expected panic '%s' but got '%v'", expected, r)
+		}
+	}()
+	vars := &Env{
+		"aa": 1.0,
+	}
+	ast, err := ParseExpr("nanmean(aa)")
+	if err != nil {
+		t.Fatalf("For expression nanmean(aa), got error %v", err)
+	}
+	Evaluate(ast, vars)
+}
+
 func TestEvaluateNilValueInEnv(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -580,11 +1136,35 @@ func TestParseExprErr(t *testing.T) {
 		expr     string
 		expected error
 	}{
-		{"(1", &ParseError{at: 1, message: "unbalanced parenthesis"}},
-		{"1)", &ParseError{at: 1, message: "unbalanced parenthesis"}},
-		{"1* (2", &ParseError{at: 4, message: "unbalanced parenthesis"}},
-		{"1 * (2 + 3", &ParseError{at: 5, message: "unbalanced parenthesis"}},
-		{"1 * (2 + 3))", &ParseError{at: 11, message: "unbalanced parenthesis"}},
+		{"(1", &ParseError{Offset: 1, Message: "unbalanced parenthesis"}},
+		{"1)", &ParseError{Offset: 1, Message: "unbalanced parenthesis"}},
+		{"1* (2", &ParseError{Offset: 4, Message: "unbalanced parenthesis"}},
+		{"1 * (2 + 3", &ParseError{Offset: 9, Message: "unbalanced parenthesis"}},
+		{"1 * (2 + 3))", &ParseError{Offset: 11, Message: "unbalanced parenthesis"}},
+		{"X[1", &ParseError{Offset: 2, Message: "Unbalanced expression: missing ']'"}},
+		{"X]", &ParseError{Offset: 1, Message: "unexpected ']' outside of brackets"}},
+		{"1 : 2", &ParseError{Offset: 2, Message: "unexpected ':' outside of brackets"}},
+		{"[1]", &ParseError{Offset: 0, Message: "unexpected '[': only values can be indexed"}},
+		{"X[]", &ParseError{Offset: 2, Message: "missing index"}},
+		{"X[1:2:3:4]", &ParseError{Offset: 7, Message: "too many ':' in slice"}},
+		{"(X[1)]", &ParseError{Offset: 4, Message: "unbalanced parenthesis"}},
+		{"X[(1])", &ParseError{Offset: 4, Message: "unbalanced parenthesis"}},
+		{"add(1, 2, 3)", &ParseError{Offset: 0, Message: "function 'add' expects 2 arguments, got 3"}},
+		{"1 + sqrt()", &ParseError{Offset: 4, Message: "function 'sqrt' expects 1 argument, got 0"}},
+		{"max(X)", &ParseError{Offset: 0, Message: "function 'max' expects at least 2 arguments, got 1"}},
+		{"add(1, )", &ParseError{Offset: 7, Message: "missing function argument"}},
+		{"add(, 1)", &ParseError{Offset: 4, Message: "missing function argument"}},
+		{"(1, 2)", &ParseError{Offset: 2, Message: "unexpected ',' outside of function arguments"}},
+		{"X[1, 2]", &ParseError{Offset: 3, Message: "unexpected ',' outside of function arguments"}},
+		{"1 + ()", &ParseError{Offset: 5, Message: "missing expression in parentheses"}},
+		{"sum + 1", &ParseError{Offset: 0, Message: "missing '(' after function 'sum'"}},
+		{"2 * foo(1)", &ParseError{Offset: 4, Message: "unknown function 'foo'"}},
+		{"host. + 1", &ParseError{Offset: 0, Message: "found unexpected token 'host.'"}},
+		{"host..cpu", &ParseError{Offset: 0, Message: "found unexpected token 'host..cpu'"}},
+		{"1 + sum(2)", &ParseError{Offset: 8, Message: "function 'sum' expects vector for argument 1, got scalar"}},
+		{"sqrt(X > 0)", &ParseError{Offset: 5, Message: "function 'sqrt' expects scalar or vector for argument 1, got bool or mask"}},
+		{"where(X + 1, X, 0)", &ParseError{Offset: 6, Message: "function 'where' expects bool or mask for argument 1, got scalar or vector"}},
+		{"max(1, 2, any(X))", &ParseError{Offset: 10, Message: "function 'max' expects scalar or vector for argument 3, got bool"}},
 	}
 	for _, test := range tests {
 		ast, err := ParseExpr(test.expr)
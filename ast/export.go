@@ -0,0 +1,114 @@
+package ast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// JSONNode is the JSON structure written by PrintJSON for each node:
+//
+//	{
+//	  "kind": "BinaryExpr",          // see Kind
+//	  "op": "+",                     // UnaryExpr and BinaryExpr operator,
+//	                                 // ":" or "::" for SliceExpr
+//	  "name": "X",                   // Ident, CallExpr and LetExpr name
+//	  "quoted": true,                // Ident written as a quoted name
+//	  "literal": "1e-3",             // NumberLit source text
+//	  "span": [0, 5],                // byte offsets of the node in the source
+//	  "children": [{...}, null, ...] // see AST.Children; omitted slice
+//	                                 // bounds are null
+//	}
+//
+// Fields that do not apply to the kind of a node are omitted.
+type JSONNode struct {
+	Kind     string      `json:"kind"`
+	Op       string      `json:"op,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Quoted   bool        `json:"quoted,omitempty"`
+	Literal  string      `json:"literal,omitempty"`
+	Span     [2]int      `json:"span"`
+	Children []*JSONNode `json:"children,omitempty"`
+}
+
+// NewJSONNode converts node and its children to JSONNode values.
+func NewJSONNode(node *AST) *JSONNode {
+	if node == nil {
+		return nil
+	}
+	j := jsonFields(node)
+	for _, child := range node.Children() {
+		j.Children = append(j.Children, NewJSONNode(child))
+	}
+	return j
+}
+
+// jsonFields returns the JSONNode of node without its children.
+func jsonFields(node *AST) *JSONNode {
+	j := &JSONNode{
+		Kind:    node.Kind().String(),
+		Op:      node.Op(),
+		Name:    node.Name(),
+		Quoted:  node.Quoted(),
+		Literal: node.Literal(),
+		Span:    [2]int{node.Pos(), node.End()},
+	}
+	if node.Kind() == SliceExpr {
+		j.Op = node.token.val
+	}
+	return j
+}
+
+// PrintJSON writes node as indented JSON, with the structure of JSONNode.
+func PrintJSON(w io.Writer, node *AST) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(NewJSONNode(node))
+}
+
+// PrintDot writes node as a Graphviz DOT graph. Each node is labelled with
+// its kind, its operator, name or literal, and its source span; the edges to
+// the bounds of a slice are labelled with the bound they hold.
+func PrintDot(w io.Writer, node *AST) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph AST {")
+	fmt.Fprintln(bw, "\tnode [shape=box];")
+	id := 0
+	var write func(n *AST) int
+	write = func(n *AST) int {
+		self := id
+		id++
+		label := n.Kind().String()
+		switch n.Kind() {
+		case NumberLit:
+			label += " " + n.Literal()
+		case Ident, CallExpr, LetExpr:
+			label += " " + formatName(n.token)
+		case UnaryExpr, BinaryExpr:
+			label += " " + n.Op()
+		case SliceExpr:
+			label += " " + sliceLabel(n)
+		}
+		label += fmt.Sprintf("\n%d:%d", n.Pos(), n.End())
+		fmt.Fprintf(bw, "\tn%d [label=%s];\n", self, strconv.Quote(label))
+		for i, child := range n.Children() {
+			if child == nil {
+				continue
+			}
+			c := write(child)
+			if n.Kind() == SliceExpr && i > 0 {
+				fmt.Fprintf(bw, "\tn%d -> n%d [label=%q];\n", self, c, []string{"start", "stop", "step"}[i-1])
+			} else {
+				fmt.Fprintf(bw, "\tn%d -> n%d;\n", self, c)
+			}
+		}
+		return self
+	}
+	if node != nil {
+		write(node)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
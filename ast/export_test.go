@@ -0,0 +1,60 @@
+package ast
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPrintDot(t *testing.T) {
+	expected := `digraph AST {
+	node [shape=box];
+	n0 [label="BinaryExpr +\n0:24"];
+	n1 [label="CallExpr add\n0:14"];
+	n2 [label="Ident aa\n4:6"];
+	n1 -> n2;
+	n3 [label="Ident \"b b\"\n8:13"];
+	n1 -> n3;
+	n0 -> n1;
+	n4 [label="SliceExpr [start::step]\n17:24"];
+	n5 [label="Ident X\n17:18"];
+	n4 -> n5;
+	n6 [label="NumberLit 1\n19:20"];
+	n4 -> n6 [label="start"];
+	n7 [label="NumberLit 2\n22:23"];
+	n4 -> n7 [label="step"];
+	n0 -> n4;
+}
+`
+	ast, err := ParseExpr(`add(aa, "b b") + X[1::2]`)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, PrintDot(&buf, ast))
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestPrintJSON(t *testing.T) {
+	expected := `{
+		"kind": "LetExpr", "name": "lo", "span": [0, 30],
+		"children": [
+			{"kind": "NumberLit", "literal": "1e-3", "span": [5, 9]},
+			{"kind": "BinaryExpr", "op": "*", "span": [11, 30], "children": [
+				{"kind": "UnaryExpr", "op": "-", "span": [11, 17], "children": [
+					{"kind": "SliceExpr", "op": ":", "span": [12, 17], "children": [
+						{"kind": "Ident", "name": "X", "span": [12, 13]},
+						null,
+						{"kind": "NumberLit", "literal": "1", "span": [15, 16]},
+						null
+					]}
+				]},
+				{"kind": "Ident", "name": "cpu load", "quoted": true, "span": [20, 30]}
+			]}
+		]
+	}`
+	ast, err := ParseExpr(`lo = 1e-3; -X[:1] * "cpu load"`)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, PrintJSON(&buf, ast))
+	assert.JSONEq(t, expected, buf.String())
+}
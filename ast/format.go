@@ -0,0 +1,146 @@
+package ast
+
+import (
+	"strings"
+)
+
+// Format returns the canonical source of node: single spaces around binary
+// operators and after commas, and only the parentheses required by the
+// precedence and associativity of operators. Functions defined by the
+// program, rather than with Define, are printed first as def statements, so
+// that ParseExpr(Format(node)) returns an AST equivalent to node.
+func Format(node *AST) string {
+	if node == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, def := range programDefs(node) {
+		b.WriteString("def ")
+		b.WriteString(def.Name)
+		b.WriteString("(")
+		b.WriteString(strings.Join(def.Params, ", "))
+		b.WriteString(") = ")
+		formatNode(&b, def.body, 0)
+		b.WriteString("; ")
+	}
+	formatNode(&b, node, 0)
+	return b.String()
+}
+
+// String returns the canonical source of the expression, see Format.
+func (n *AST) String() string {
+	return Format(n)
+}
+
+// programDefs returns the functions called from node, directly or through
+// other functions, that are not the ones currently registered with Define,
+// callees first.
+func programDefs(node *AST) []*FuncDef {
+	var defs []*FuncDef
+	seen := make(map[*FuncDef]bool)
+	var visit func(n *AST) bool
+	visit = func(n *AST) bool {
+		if n == nil {
+			return false
+		}
+		if def := n.token.def; def != nil && !seen[def] {
+			seen[def] = true
+			Inspect(def.body, visit)
+			if lookupDef(def.Name) != def {
+				defs = append(defs, def)
+			}
+		}
+		return true
+	}
+	Inspect(node, visit)
+	return defs
+}
+
+// bindingPower returns the precedence of the operator of node; operands that
+// are not operators bind tightest.
+func bindingPower(node *AST) int {
+	switch node.token.typ {
+	case operator, unary:
+		return precedence(node.token)
+	case let:
+		return 0
+	}
+	return 10
+}
+
+// formatNode writes the source of node, followed in the output by an
+// operator of precedence next, or by no operator when next is 0.
+func formatNode(b *strings.Builder, node *AST, next int) {
+	switch node.token.typ {
+	case number:
+		b.WriteString(node.token.val)
+	case name:
+		b.WriteString(formatName(node.token))
+	case let:
+		b.WriteString(node.token.val)
+		b.WriteString(" = ")
+		formatNode(b, node.left, 0)
+		b.WriteString("; ")
+		formatNode(b, node.right, next)
+	case unary:
+		b.WriteString(node.token.val)
+		if node.token.val == "not" {
+			b.WriteString(" ")
+		}
+		formatOperand(b, node.right, bindingPower(node.right) < precedence(node.token), next)
+	case function:
+		b.WriteString(node.token.val)
+		b.WriteString("(")
+		for i, arg := range node.args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			formatNode(b, arg, 0)
+		}
+		b.WriteString(")")
+	case index:
+		formatOperand(b, node.left, bindingPower(node.left) < 10, 0)
+		b.WriteString("[")
+		formatNode(b, node.right, 0)
+		b.WriteString("]")
+	case slice:
+		formatOperand(b, node.left, bindingPower(node.left) < 10, 0)
+		b.WriteString("[")
+		for i, bound := range node.args[:len(node.token.val)+1] {
+			if i > 0 {
+				b.WriteString(":")
+			}
+			if bound != nil {
+				formatNode(b, bound, 0)
+			}
+		}
+		b.WriteString("]")
+	default:
+		p := precedence(node.token)
+		left, right := bindingPower(node.left), bindingPower(node.right)
+		formatOperand(b, node.left, left < p || (left == p && isRightAssociative(node.token)), p)
+		b.WriteString(" ")
+		b.WriteString(node.token.val)
+		b.WriteString(" ")
+		parens := right < p || (right == p && !isRightAssociative(node.token))
+		if node.right.token.typ == unary {
+			// a prefix operator on the right only needs parentheses when
+			// it would extend over the operator following node
+			parens = right < next
+		}
+		formatOperand(b, node.right, parens, next)
+	}
+}
+
+// formatOperand writes node, in parentheses if parens is set, followed by an
+// operator of precedence next.
+func formatOperand(b *strings.Builder, node *AST, parens bool, next int) {
+	if parens {
+		next = 0
+		b.WriteString("(")
+	}
+	formatNode(b, node, next)
+	if parens {
+		b.WriteString(")")
+	}
+}
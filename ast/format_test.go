@@ -0,0 +1,99 @@
+package ast
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"(1+2)*3", "(1 + 2) * 3"},
+		{"((X))", "X"},
+		{"a - (b - c)", "a - (b - c)"},
+		{"(a - b) - c", "a - b - c"},
+		{"a / (b * c)", "a / (b * c)"},
+		{"2 ^ 3 ^ 2", "2 ^ 3 ^ 2"},
+		{"(2 ^ 3) ^ 2", "(2 ^ 3) ^ 2"},
+		{"2 ** (3 ** 2)", "2 ** 3 ** 2"},
+		{"-X ^ 2", "-X ^ 2"},
+		{"(-X) ^ 2", "(-X) ^ 2"},
+		{"X ^ -1", "X ^ -1"},
+		{"2 ** (-X)", "2 ** -X"},
+		{"X ^ -1 * 3", "X ^ -1 * 3"},
+		{"X ^ (-1 ^ 2)", "X ^ -1 ^ 2"},
+		{"a < (not b)", "a < not b"},
+		{"a < (not b) < c", "a < (not b) < c"},
+		{"a < (not b) and c", "a < not b and c"},
+		{"-(X + 1)", "-(X + 1)"},
+		{"2 - -X", "2 - -X"},
+		{"- - X", "--X"},
+		{"not (X > 0 and Y > 0)", "not (X > 0 and Y > 0)"},
+		{"not X > 0 or Y", "not X > 0 or Y"},
+		{"(not X) == Y", "(not X) == Y"},
+		{"A * (not B) + C", "A * (not B) + C"},
+		{"(A or B) and C", "(A or B) and C"},
+		{"max(X,0,  -Y)", "max(X, 0, -Y)"},
+		{"(X*2)[0] + abs(Y)[-n::2]", "(X * 2)[0] + abs(Y)[-n::2]"},
+		{"X[:] + X[::] + X[1:] + X[:2] + X[::-1]", "X[:] + X[::] + X[1:] + X[:2] + X[::-1]"},
+		{"X[i+1 : n*2]", "X[i + 1:n * 2]"},
+		{`"cpu load" * "X"`, `"cpu load" * "X"`},
+		{"lo=nanmin(X);hi=nanmax(X);(X-lo)/(hi-lo)", "lo = nanmin(X); hi = nanmax(X); (X - lo) / (hi - lo)"},
+		{"def sq(v) = v*v; def f(a, b) = sq(a) + b; f(X, 1)", "def sq(v) = v * v; def f(a, b) = sq(a) + b; f(X, 1)"},
+		{"def f(x) = x; a = f(1); def g(y) = f(y) * 2; a + g(1)", "def f(x) = x; def g(y) = f(y) * 2; a = f(1); a + g(1)"},
+		{"def g(y) = y; x = g(1); def f(x) = g(x) + x; f(x)", "def g(y) = y; def f(x) = g(x) + x; x = g(1); f(x)"},
+		{"# comment\n1e-3 +\n\t.5", "1e-3 + .5"},
+	}
+	for _, test := range tests {
+		ast, err := ParseExpr(test.expr)
+		require.NoError(t, err, test.expr)
+		actual := Format(ast)
+		assert.Equal(t, test.expected, actual, test.expr)
+		assert.Equal(t, test.expected, ast.String(), test.expr)
+
+		again, err := ParseExpr(actual)
+		require.NoError(t, err, actual)
+		assert.Equal(t, treeString(ast), treeString(again), test.expr)
+		assert.Equal(t, callTargets(ast), callTargets(again), test.expr)
+	}
+}
+
+func TestFormatDefine(t *testing.T) {
+	def, err := ParseDef("def testformat(v) = v + 1")
+	require.NoError(t, err)
+	Define(def)
+	defer Undefine("testformat")
+	ast, err := ParseExpr("testformat(X)*2")
+	require.NoError(t, err)
+	assert.Equal(t, "testformat(X) * 2", Format(ast))
+}
+
+// callTargets lists the calls of node, with the source of the functions they
+// call, which treeString does not show.
+func callTargets(node *AST) []string {
+	var calls []string
+	var visit func(n *AST) bool
+	visit = func(n *AST) bool {
+		if n == nil {
+			return false
+		}
+		if def := n.token.def; def != nil {
+			calls = append(calls, def.Name+" = "+Format(def.body))
+			Inspect(def.body, visit)
+		}
+		return true
+	}
+	Inspect(node, visit)
+	return calls
+}
+
+func treeString(node *AST) string {
+	var buf bytes.Buffer
+	PrettyPrint(&buf, node, "")
+	return buf.String()
+}
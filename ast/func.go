@@ -0,0 +1,268 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	funcsMu sync.RWMutex
+	funcs   = make(map[string]*Func)
+)
+
+// RegisterFunc makes fn callable from the expressions parsed afterwards,
+// replacing any previous function with the same name. A function defined
+// with def, in the program or with Define, hides fn.
+func RegisterFunc(fn *Func) error {
+	if err := validateFunc(fn); err != nil {
+		return err
+	}
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	funcs[fn.Name] = fn
+	return nil
+}
+
+// UnregisterFunc removes the function name registered with RegisterFunc.
+func UnregisterFunc(name string) {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	delete(funcs, name)
+}
+
+func lookupFunc(name string) *Func {
+	funcsMu.RLock()
+	defer funcsMu.RUnlock()
+	return funcs[name]
+}
+
+// validateFunc checks that fn can be called from expressions.
+func validateFunc(fn *Func) error {
+	if fn == nil {
+		return fmt.Errorf("invalid function: nil")
+	}
+	if isBuiltin(fn.Name) {
+		return fmt.Errorf("cannot redefine builtin function '%s'", fn.Name)
+	}
+	tokens, errs := tokenize(fn.Name, 0)
+	if len(errs) > 0 || len(tokens) != 1 || tokens[0].quoted || tokens[0].val != fn.Name ||
+		tokens[0].typ != name || strings.Contains(fn.Name, ".") || fn.Name == "def" {
+		return fmt.Errorf("invalid function name '%s'", fn.Name)
+	}
+	if fn.Call == nil {
+		return fmt.Errorf("function '%s' has no implementation", fn.Name)
+	}
+	if fn.Variadic && len(fn.Params) == 0 {
+		return fmt.Errorf("variadic function '%s' has no parameters", fn.Name)
+	}
+	for i, param := range fn.Params {
+		if param&Any == 0 {
+			return fmt.Errorf("parameter %d of function '%s' accepts no type", i+1, fn.Name)
+		}
+	}
+	if fn.Result&Any == 0 {
+		return fmt.Errorf("function '%s' returns no type", fn.Name)
+	}
+	return nil
+}
+
+// resolveFunc returns the function called name: a builtin, a function
+// defined earlier in the program, one given to ParseExprFuncs, or one
+// registered with Define or RegisterFunc, in this order. Both results are
+// nil for unknown functions.
+func (p *parser) resolveFunc(name string) (*FuncDef, *Func) {
+	if fn := lookupBuiltin(name); fn != nil {
+		return nil, fn
+	}
+	if def, ok := p.defs[name]; ok {
+		return def, nil
+	}
+	if fn, ok := p.funcs[name]; ok {
+		return nil, fn
+	}
+	if def := lookupDef(name); def != nil {
+		return def, nil
+	}
+	return nil, lookupFunc(name)
+}
+
+var (
+	goFloat64 = reflect.TypeOf(float64(0))
+	goBool    = reflect.TypeOf(false)
+	goAny     = reflect.TypeOf((*interface{})(nil)).Elem()
+	goError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// goTypes maps the Go types that functions given to NewFunc can take and
+// return to the types of values they hold.
+var goTypes = map[reflect.Type]Type{
+	goFloat64:                      Scalar,
+	reflect.TypeOf([]float64(nil)): Vector,
+	goBool:                         Bool,
+	reflect.TypeOf([]bool(nil)):    Mask,
+	goAny:                          Any,
+}
+
+// NewFunc returns a Func calling the Go function impl, whose parameters and
+// result can be float64, []float64, bool, []bool or interface{}. The result
+// can be followed by an error, which fails the evaluation.
+//
+// Like the builtin math functions, a function of float64 or bool parameters
+// that returns a float64 or a bool is applied element-wise when vectors or
+// masks are passed as these arguments: scalars are broadcast, and all the
+// vectors must have the same length. A float32 value is converted to
+// float64.
+//
+// A variadic impl can be called with any number of arguments for its last
+// parameter, including none.
+//
+// The signature optionally narrows the types each argument accepts, one per
+// parameter of impl; it is required for interface{} parameters to accept
+// less than Any.
+func NewFunc(name string, impl interface{}, signature ...Type) (*Func, error) {
+	v := reflect.ValueOf(impl)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("function '%s' is implemented by %T, not a Go function", name, impl)
+	}
+	t := v.Type()
+	if t.NumOut() < 1 || t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != goError {
+		return nil, fmt.Errorf("function '%s' must return a value, and optionally an error", name)
+	}
+	result, ok := goTypes[t.Out(0)]
+	if !ok {
+		return nil, fmt.Errorf("function '%s' cannot return %s", name, t.Out(0))
+	}
+	if len(signature) > 0 && len(signature) != t.NumIn() {
+		return nil, fmt.Errorf("function '%s' has %d parameters but a signature of %d types", name, t.NumIn(), len(signature))
+	}
+	elementWise := t.Out(0) == goFloat64 || t.Out(0) == goBool
+	broadcasts := false
+	ins := make([]reflect.Type, t.NumIn())
+	fn := &Func{Name: name, Variadic: t.IsVariadic(), Result: result, optional: t.IsVariadic()}
+	for i := range ins {
+		ins[i] = t.In(i)
+		if fn.Variadic && i == len(ins)-1 {
+			ins[i] = ins[i].Elem()
+		}
+		param, ok := goTypes[ins[i]]
+		if !ok {
+			return nil, fmt.Errorf("parameter %d of function '%s' cannot be %s", i+1, name, ins[i])
+		}
+		if elementWise && param == Scalar {
+			param = Number
+		} else if elementWise && param == Bool {
+			param = Logical
+		}
+		if len(signature) > 0 {
+			if signature[i]&^param != 0 {
+				return nil, fmt.Errorf("parameter %d of function '%s' cannot take %s", i+1, name, signature[i]&^param)
+			}
+			param = signature[i]
+		}
+		if (ins[i] == goFloat64 || ins[i] == goBool) && param&(Vector|Mask) != 0 {
+			broadcasts = true
+		}
+		fn.Params = append(fn.Params, param)
+	}
+	if broadcasts {
+		fn.Result |= fn.Result << 1 // Scalar to Number, Bool to Logical
+	}
+	fn.Call = func(args []interface{}) interface{} {
+		return callGo(fn, v, ins, args)
+	}
+	if err := validateFunc(fn); err != nil {
+		return nil, err
+	}
+	return fn, nil
+}
+
+// callGo calls the Go function impl, with parameter types ins, element-wise
+// over the vectors and masks passed for its scalar parameters.
+func callGo(fn *Func, impl reflect.Value, ins []reflect.Type, args []interface{}) interface{} {
+	in := make([]reflect.Value, len(args))
+	length := -1
+	for i, arg := range args {
+		t := ins[len(ins)-1]
+		if i < len(ins) {
+			t = ins[i]
+		}
+		if t != goFloat64 && t != goBool {
+			in[i] = goValue(arg, t)
+			continue
+		}
+		n := -1
+		switch x := arg.(type) {
+		case []float64:
+			n = len(x)
+		case []float32:
+			n = len(x)
+		case []bool:
+			n = len(x)
+		default:
+			in[i] = goValue(arg, t)
+		}
+		if n == -1 {
+			continue
+		}
+		if length != -1 && n != length {
+			panic(fmt.Sprintf("function '%s' has vector arguments of mismatched lengths %d and %d", fn.Name, length, n))
+		}
+		length = n
+	}
+	if length == -1 {
+		return callValue(fn, impl, in)
+	}
+
+	var out reflect.Value
+	if impl.Type().Out(0) == goBool {
+		out = reflect.ValueOf(make([]bool, length))
+	} else {
+		out = reflect.ValueOf(make([]float64, length))
+	}
+	element := make([]reflect.Value, len(args))
+	for j := 0; j < length; j++ {
+		for i, arg := range args {
+			if in[i].IsValid() {
+				// a broadcast scalar, or the argument of a parameter that is
+				// not applied element-wise
+				element[i] = in[i]
+				continue
+			}
+			switch x := arg.(type) {
+			case []float64:
+				element[i] = reflect.ValueOf(x[j])
+			case []float32:
+				element[i] = reflect.ValueOf(float64(x[j]))
+			case []bool:
+				element[i] = reflect.ValueOf(x[j])
+			}
+		}
+		out.Index(j).Set(reflect.ValueOf(callValue(fn, impl, element)))
+	}
+	return out.Interface()
+}
+
+// goValue converts an evaluated argument to the Go type t.
+func goValue(arg interface{}, t reflect.Type) reflect.Value {
+	if t == goAny {
+		return reflect.ValueOf(&arg).Elem()
+	}
+	switch x := arg.(type) {
+	case float32:
+		return reflect.ValueOf(float64(x))
+	case []float32:
+		return reflect.ValueOf(castFloat64(x))
+	}
+	return reflect.ValueOf(arg)
+}
+
+// callValue calls impl, turning the error it returns into a panic.
+func callValue(fn *Func, impl reflect.Value, in []reflect.Value) interface{} {
+	out := impl.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		panic(fmt.Sprintf("function '%s': %v", fn.Name, out[1].Interface()))
+	}
+	return out[0].Interface()
+}
@@ -0,0 +1,295 @@
+package ast
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func hypot(x, y float64) float64 {
+	return math.Hypot(x, y)
+}
+
+func TestNewFunc(t *testing.T) {
+	fn, err := NewFunc("hypot", hypot)
+	require.NoError(t, err)
+	assert.Equal(t, []Type{Number, Number}, fn.Params)
+	assert.Equal(t, Number, fn.Result)
+	assert.False(t, fn.Variadic)
+
+	env := &Env{
+		"S":   3.0,
+		"S32": float32(3),
+		"V":   []float64{3, 6},
+		"V32": []float32{3, 6},
+	}
+	tests := []struct {
+		code     string
+		expected interface{}
+	}{
+		{"hypot(S, 4)", 5.0},
+		{"hypot(S32, 4)", 5.0},
+		{"hypot(V, 4)", []float64{5, math.Hypot(6, 4)}},
+		{"hypot(4, V32)", []float64{5, math.Hypot(4, 6)}},
+		{"hypot(V, V32)", []float64{math.Hypot(3, 3), math.Hypot(6, 6)}},
+	}
+	for _, test := range tests {
+		program, err := ParseExprFuncs(test.code, 0, fn)
+		require.NoError(t, err, test.code)
+		assert.Same(t, fn, program.Func(), test.code)
+		assert.Equal(t, test.expected, Evaluate(program, env), test.code)
+	}
+}
+
+func TestNewFuncTypes(t *testing.T) {
+	tests := []struct {
+		impl     interface{}
+		params   []Type
+		variadic bool
+		result   Type
+	}{
+		{func(x float64) bool { return x > 0 }, []Type{Number}, false, Logical},
+		{func(b bool, x float64) float64 { return x }, []Type{Logical, Number}, false, Number},
+		{func(v []float64, x float64) float64 { return x }, []Type{Vector, Number}, false, Number},
+		{func(v []float64) []float64 { return v }, []Type{Vector}, false, Vector},
+		{func(m []bool) bool { return m[0] }, []Type{Mask}, false, Bool},
+		{func(x float64) []float64 { return nil }, []Type{Scalar}, false, Vector},
+		{func(x interface{}) interface{} { return x }, []Type{Any}, false, Any},
+		{func(x interface{}) float64 { return 0 }, []Type{Any}, false, Scalar},
+		{func(xs ...float64) float64 { return 0 }, []Type{Number}, true, Number},
+		{func() float64 { return 1 }, nil, false, Scalar},
+		{func(x float64) (float64, error) { return x, nil }, []Type{Number}, false, Number},
+	}
+	for _, test := range tests {
+		fn, err := NewFunc("f", test.impl)
+		require.NoError(t, err, "%T", test.impl)
+		assert.Equal(t, test.params, fn.Params, "%T", test.impl)
+		assert.Equal(t, test.variadic, fn.Variadic, "%T", test.impl)
+		assert.Equal(t, test.result, fn.Result, "%T", test.impl)
+	}
+}
+
+func TestNewFuncSliceParams(t *testing.T) {
+	// only the float64 and bool parameters are applied element-wise
+	dev := func(v []float64, x float64) float64 {
+		return x - v[0]
+	}
+	fn, err := NewFunc("dev", dev)
+	require.NoError(t, err)
+	program, err := ParseExprFuncs("dev(V, X)", 0, fn)
+	require.NoError(t, err)
+	env := &Env{"V": []float64{1, 5, 9}, "V32": []float32{2, 4}, "X": []float64{3, 4}, "S": 7.0}
+	assert.Equal(t, []float64{2, 3}, Evaluate(program, env))
+	program, err = ParseExprFuncs("dev(V32, X) + dev(V, S)", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{7, 8}, Evaluate(program, env))
+
+	pick := func(m []bool, b bool) bool {
+		return m[0] && b
+	}
+	fn, err = NewFunc("pick", pick)
+	require.NoError(t, err)
+	program, err = ParseExprFuncs("pick(X > 1, X > 3)", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true}, Evaluate(program, &Env{"X": []float64{2, 4, 5}}))
+
+	first := func(x interface{}, y float64) float64 {
+		return x.([]float64)[0] + y
+	}
+	fn, err = NewFunc("first", first)
+	require.NoError(t, err)
+	program, err = ParseExprFuncs("first(V, X)", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{4, 5}, Evaluate(program, env))
+}
+
+func TestNewFuncSignature(t *testing.T) {
+	fn, err := NewFunc("hypot", hypot, Scalar, Scalar)
+	require.NoError(t, err)
+	assert.Equal(t, []Type{Scalar, Scalar}, fn.Params)
+	assert.Equal(t, Scalar, fn.Result)
+	_, err = ParseExprFuncs("hypot(X[0], 1)", 0, fn)
+	assert.NoError(t, err)
+	program, err := ParseExprFuncs("hypot(X, 1)", 0, fn)
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, "function 'hypot' expects scalar for argument 1, got []float64", func() {
+		Evaluate(program, &Env{"X": []float64{1, 2}})
+	})
+	_, err = ParseExprFuncs("hypot(X > 0, 1)", 0, fn)
+	assert.EqualError(t, err, "function 'hypot' expects scalar for argument 1, got bool or mask at position 6")
+
+	fn, err = NewFunc("first", func(x interface{}) interface{} { return x }, Vector|Mask)
+	require.NoError(t, err)
+	assert.Equal(t, []Type{Vector | Mask}, fn.Params)
+	_, err = ParseExprFuncs("first(1)", 0, fn)
+	assert.EqualError(t, err, "function 'first' expects vector or mask for argument 1, got scalar at position 6")
+
+	_, err = NewFunc("hypot", hypot, Scalar)
+	assert.EqualError(t, err, "function 'hypot' has 2 parameters but a signature of 1 types")
+	_, err = NewFunc("hypot", hypot, Scalar, Mask|Scalar)
+	assert.EqualError(t, err, "parameter 2 of function 'hypot' cannot take mask")
+	_, err = NewFunc("hypot", hypot, Scalar, 0)
+	assert.EqualError(t, err, "parameter 2 of function 'hypot' accepts no type")
+}
+
+func TestNewFuncErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		impl     interface{}
+		expected string
+	}{
+		{"f", 1.0, "function 'f' is implemented by float64, not a Go function"},
+		{"f", (func(float64) float64)(nil), "function 'f' is implemented by func(float64) float64, not a Go function"},
+		{"f", func(x float64) {}, "function 'f' must return a value, and optionally an error"},
+		{"f", func(x float64) (float64, bool) { return x, true }, "function 'f' must return a value, and optionally an error"},
+		{"f", func(x float64) int { return 0 }, "function 'f' cannot return int"},
+		{"f", func(x, y float64, s string) float64 { return x }, "parameter 3 of function 'f' cannot be string"},
+		{"f", func(xs ...int) float64 { return 0 }, "parameter 1 of function 'f' cannot be int"},
+		{"sqrt", math.Sqrt, "cannot redefine builtin function 'sqrt'"},
+		{"maximum", math.Max, "cannot redefine builtin function 'maximum'"},
+		{"pi", math.Sqrt, "invalid function name 'pi'"},
+		{"and", math.Sqrt, "invalid function name 'and'"},
+		{"def", math.Sqrt, "invalid function name 'def'"},
+		{"math.sqrt", math.Sqrt, "invalid function name 'math.sqrt'"},
+		{"1f", math.Sqrt, "invalid function name '1f'"},
+		{"", math.Sqrt, "invalid function name ''"},
+	}
+	for _, test := range tests {
+		_, err := NewFunc(test.name, test.impl)
+		assert.EqualError(t, err, test.expected, test.name)
+	}
+}
+
+func TestFuncPanics(t *testing.T) {
+	safeLog := func(x float64) (float64, error) {
+		if x <= 0 {
+			return 0, errors.New("logarithm of a non-positive number")
+		}
+		return math.Log(x), nil
+	}
+	fn, err := NewFunc("safelog", safeLog)
+	require.NoError(t, err)
+	program, err := ParseExprFuncs("safelog(X)", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0, math.Log(2)}, Evaluate(program, &Env{"X": []float64{1, 2}}))
+	assert.PanicsWithValue(t, "function 'safelog': logarithm of a non-positive number", func() {
+		Evaluate(program, &Env{"X": []float64{1, 0}})
+	})
+
+	fn, err = NewFunc("hypot", hypot)
+	require.NoError(t, err)
+	program, err = ParseExprFuncs("hypot(X, Y)", 0, fn)
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, "function 'hypot' has vector arguments of mismatched lengths 2 and 3", func() {
+		Evaluate(program, &Env{"X": []float64{1, 2}, "Y": []float64{1, 2, 3}})
+	})
+	assert.PanicsWithValue(t, "function 'hypot' expects scalar or vector for argument 2, got []bool", func() {
+		Evaluate(program, &Env{"X": []float64{1, 2}, "Y": []bool{true, false}})
+	})
+}
+
+func TestNewFuncVariadic(t *testing.T) {
+	mean := func(xs ...float64) float64 {
+		total := 0.0
+		for _, x := range xs {
+			total += x
+		}
+		return total / float64(len(xs))
+	}
+	fn, err := NewFunc("mean", mean)
+	require.NoError(t, err)
+	program, err := ParseExprFuncs("mean(X, 2, Y)", 0, fn)
+	require.NoError(t, err)
+	env := &Env{"X": []float64{1, 4}, "Y": 3.0}
+	assert.Equal(t, []float64{2, 3}, Evaluate(program, env))
+	program, err = ParseExprFuncs("mean()", 0, fn)
+	require.NoError(t, err)
+	assert.True(t, math.IsNaN(Evaluate(program, nil).(float64)))
+
+	// only the fixed parameters need arguments
+	weighted := func(w []float64, xs ...float64) float64 {
+		total := 0.0
+		for i, x := range xs {
+			total += w[i] * x
+		}
+		return total
+	}
+	fn, err = NewFunc("weighted", weighted)
+	require.NoError(t, err)
+	program, err = ParseExprFuncs("weighted(W)", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, Evaluate(program, &Env{"W": []float64{1, 2}}))
+	program, err = ParseExprFuncs("weighted(W, 3, 4)", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, 11.0, Evaluate(program, &Env{"W": []float64{1, 2}}))
+	_, err = ParseExprFuncs("weighted()", 0, fn)
+	assert.EqualError(t, err, "function 'weighted' expects at least 1 argument, got 0 at position 0")
+}
+
+func TestRegisterFunc(t *testing.T) {
+	fn, err := NewFunc("testhypot", hypot)
+	require.NoError(t, err)
+	require.NoError(t, RegisterFunc(fn))
+	defer UnregisterFunc("testhypot")
+
+	program, err := ParseExpr("testhypot(X, 4) + 1")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{6, 1 + math.Hypot(0, 4)}, Evaluate(program, &Env{"X": []float64{3, 0}}))
+	_, err = ParseExpr("testhypot(X)")
+	assert.EqualError(t, err, "function 'testhypot' expects 2 arguments, got 1 at position 0")
+	_, err = ParseExpr("testhypot(X > 1, 2)")
+	assert.EqualError(t, err, "function 'testhypot' expects scalar or vector for argument 1, got bool or mask at position 10")
+
+	// the name is still read as a variable when it is not called
+	program, err = ParseExpr("testhypot + 1")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, Evaluate(program, &Env{"testhypot": 2.0}))
+	program, err = ParseExprFuncs("testhypot * 2", 0, fn)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, Evaluate(program, &Env{"testhypot": 2.0}))
+	program, err = ParseExpr("testhypot = 2; testhypot(testhypot, 1) * testhypot")
+	require.NoError(t, err)
+	assert.Equal(t, 2*math.Hypot(2, 1), Evaluate(program, nil))
+
+	// functions given to the parser, then defined with def, hide the
+	// registered one
+	other, err := NewFunc("testhypot", func(x, y float64) float64 { return x + y })
+	require.NoError(t, err)
+	program, err = ParseExprFuncs("testhypot(3, 4)", 0, other)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, Evaluate(program, nil))
+	program, err = ParseExprFuncs("def testhypot(x, y) = x * y; testhypot(3, 4)", 0, other)
+	require.NoError(t, err)
+	assert.Equal(t, 12.0, Evaluate(program, nil))
+
+	assert.EqualError(t, RegisterFunc(&Func{Name: "testnil"}), "function 'testnil' has no implementation")
+	assert.EqualError(t, RegisterFunc(&Func{Name: "testv", Variadic: true, Call: fn.Call}), "variadic function 'testv' has no parameters")
+	assert.EqualError(t, RegisterFunc(&Func{Name: "testdbl", Params: []Type{Number}, Call: fn.Call}), "function 'testdbl' returns no type")
+	assert.EqualError(t, RegisterFunc(nil), "invalid function: nil")
+	_, err = ParseExprFuncs("1", 0, &Func{Name: "abs", Params: []Type{Number}, Call: fn.Call})
+	assert.EqualError(t, err, "cannot redefine builtin function 'abs'")
+
+	UnregisterFunc("testhypot")
+	_, err = ParseExpr("testhypot(X, 4)")
+	assert.EqualError(t, err, "unknown function 'testhypot' at position 0")
+}
+
+func TestMarshalRegisteredFunc(t *testing.T) {
+	fn, err := NewFunc("testhypot", hypot)
+	require.NoError(t, err)
+	require.NoError(t, RegisterFunc(fn))
+	program, err := ParseExpr("testhypot(X, 4)")
+	require.NoError(t, err)
+	data, err := program.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded AST
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Same(t, fn, decoded.Func())
+	assert.Equal(t, 5.0, Evaluate(&decoded, &Env{"X": 3.0}))
+
+	UnregisterFunc("testhypot")
+	assert.EqualError(t, decoded.UnmarshalBinary(data), "invalid encoded program: unknown function 'testhypot'")
+}
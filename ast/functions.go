@@ -0,0 +1,354 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Type is a set of the types of the values computed by expressions, used to
+// declare the arguments and the result of functions.
+type Type uint
+
+const (
+	Scalar Type = 1 << iota // float64 or float32
+	Vector                  // []float64 or []float32
+	Bool                    // bool
+	Mask                    // []bool
+
+	Number  = Scalar | Vector
+	Logical = Bool | Mask
+	Any     = Number | Logical
+)
+
+var typeNames = []string{"scalar", "vector", "bool", "mask"}
+
+func (t Type) String() string {
+	var names []string
+	for i, name := range typeNames {
+		if t&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "unsupported type"
+	}
+	return strings.Join(names, " or ")
+}
+
+// typeOf returns the type of an evaluated value, or 0 if functions cannot
+// take it as an argument.
+func typeOf(value interface{}) Type {
+	switch value.(type) {
+	case float64, float32:
+		return Scalar
+	case []float64, []float32:
+		return Vector
+	case bool:
+		return Bool
+	case []bool:
+		return Mask
+	}
+	return 0
+}
+
+// Func is a function implemented in Go. Params lists the types each argument
+// accepts, and the arguments of a Variadic function beyond Params take the
+// type of the last one. Result lists the types the function can return.
+// Both are checked at compile time as far as the types of the arguments are
+// known, and Call is only given arguments of the declared types.
+type Func struct {
+	Name     string
+	Params   []Type
+	Variadic bool
+	Result   Type
+	Call     func(args []interface{}) interface{}
+
+	aliases []string
+	// optional is set for the Go variadic functions given to NewFunc, whose
+	// last parameter can take no argument.
+	optional bool
+}
+
+// arity is the number of arguments a function accepts; max is variadic
+// when there is no upper bound.
+type arity struct {
+	min int
+	max int
+}
+
+const variadic = -1
+
+func (f *Func) arity() arity {
+	if f.Variadic && f.optional {
+		return arity{len(f.Params) - 1, variadic}
+	} else if f.Variadic {
+		return arity{len(f.Params), variadic}
+	}
+	return arity{len(f.Params), len(f.Params)}
+}
+
+// param returns the types accepted by the argument at index i.
+func (f *Func) param(i int) Type {
+	if i >= len(f.Params) {
+		return f.Params[len(f.Params)-1]
+	}
+	return f.Params[i]
+}
+
+// math1 declares an element-wise function of a scalar or a vector.
+func math1(name string, fn func(a interface{}) interface{}, aliases ...string) *Func {
+	return &Func{
+		Name:    name,
+		Params:  []Type{Number},
+		Result:  Number,
+		Call:    func(args []interface{}) interface{} { return fn(args[0]) },
+		aliases: aliases,
+	}
+}
+
+// math2 declares an element-wise function of two scalars or vectors, which
+// broadcasts a scalar against a vector.
+func math2(name string, fn func(a, b interface{}) interface{}, aliases ...string) *Func {
+	return &Func{
+		Name:    name,
+		Params:  []Type{Number, Number},
+		Result:  Number,
+		Call:    func(args []interface{}) interface{} { return fn(args[0], args[1]) },
+		aliases: aliases,
+	}
+}
+
+// fold declares a variadic function applying fn to its arguments in turn.
+func fold(name string, fn func(a, b interface{}) interface{}, aliases ...string) *Func {
+	f := math2(name, nil, aliases...)
+	f.Variadic = true
+	f.Call = func(args []interface{}) interface{} {
+		out := args[0]
+		for _, arg := range args[1:] {
+			out = fn(out, arg)
+		}
+		return out
+	}
+	return f
+}
+
+// reduce declares a function computing a scalar from a vector or a mask.
+func reduce(name string, param Type, fn func(a interface{}) interface{}) *Func {
+	return &Func{
+		Name:   name,
+		Params: []Type{param},
+		Result: Scalar,
+		Call:   func(args []interface{}) interface{} { return fn(args[0]) },
+	}
+}
+
+// builtins is the registry of the functions implemented in Go. It drives
+// the tokenizer, which reads their names and aliases as function names, the
+// compile-time arity and type checks, and the evaluation of calls.
+var builtins = []*Func{
+	math2("add", add),
+	math2("sub", subtract),
+	math2("mul", multiply),
+	math2("div", divide),
+	math2("mod", mod),
+	math2("pow", pow),
+	math2("remainder", remainder),
+	fold("min", min, "minimum"),
+	fold("max", max, "maximum"),
+	math1("abs", abs),
+	math1("acos", acos),
+	math1("acosh", acosh),
+	math1("asin", asin),
+	math1("asinh", asinh),
+	math1("atan", atan),
+	math1("atanh", atanh),
+	math1("cbrt", cbrt),
+	math1("ceil", ceil),
+	math1("cos", cos),
+	math1("cosh", cosh),
+	math1("erf", erf),
+	math1("erfc", erfc),
+	math1("erfcinv", erfcinv),
+	math1("erfinv", erfinv),
+	math1("exp", exp),
+	math1("exp2", exp2),
+	math1("expm1", expm1),
+	math1("floor", floor),
+	math1("gamma", gamma),
+	math1("j0", j0),
+	math1("j1", j1),
+	math1("log", log),
+	math1("log10", log10),
+	math1("log1p", log1p),
+	math1("log2", log2),
+	math1("logb", logb),
+	math1("round", round),
+	math1("roundtoeven", roundtoeven, "roundToEven"),
+	math1("sin", sin),
+	math1("sinh", sinh),
+	math1("sqrt", sqrt),
+	math1("tan", tan),
+	math1("tanh", tanh),
+	math1("trunc", trunc),
+	math1("y0", y0),
+	math1("y1", y1),
+	reduce("sum", Vector, sum),
+	reduce("nanmin", Vector, nanmin),
+	reduce("nanmax", Vector, nanmax),
+	reduce("nanmean", Vector, nanmean),
+	reduce("nanstd", Vector, nanstd),
+	reduce("nansum", Vector, nansum),
+	reduce("nanprod", Vector, nanprod),
+	reduce("count", Logical, countTrue),
+	{
+		Name:   "isnan",
+		Params: []Type{Number},
+		Result: Logical,
+		Call:   func(args []interface{}) interface{} { return isnan(args[0]) },
+	},
+	{
+		Name:   "any",
+		Params: []Type{Logical},
+		Result: Bool,
+		Call:   func(args []interface{}) interface{} { return anyTrue(args[0]) },
+	},
+	{
+		Name:   "all",
+		Params: []Type{Logical},
+		Result: Bool,
+		Call:   func(args []interface{}) interface{} { return allTrue(args[0]) },
+	},
+	{
+		Name:   "where",
+		Params: []Type{Logical, Number, Number},
+		Result: Number,
+		Call:   func(args []interface{}) interface{} { return where(args[0], args[1], args[2]) },
+	},
+}
+
+// builtinNames maps the names and aliases of the builtins to their entry.
+var builtinNames = make(map[string]*Func)
+
+func init() {
+	for _, f := range builtins {
+		builtinNames[f.Name] = f
+		for _, alias := range f.aliases {
+			builtinNames[alias] = f
+		}
+	}
+}
+
+func lookupBuiltin(name string) *Func {
+	return builtinNames[name]
+}
+
+// functionName returns the name under which the tokenizer records a call to
+// the function name: the name of a builtin rather than its alias.
+func functionName(name string) string {
+	if f := lookupBuiltin(name); f != nil {
+		return f.Name
+	}
+	return name
+}
+
+// isBuiltin reports whether token names a builtin function. Functions
+// defined with def, given to the parser or registered with RegisterFunc are
+// only told apart from variables by the '(' that follows them, so that adding
+// one does not break the expressions using its name as a variable.
+func isBuiltin(token string) bool {
+	return lookupBuiltin(token) != nil
+}
+
+// checkArity verifies at compile time that a call passes as many arguments as
+// the function accepts.
+func checkArity(expression string, fn Token) *ParseError {
+	var a arity
+	if fn.def != nil {
+		a = arity{len(fn.def.Params), len(fn.def.Params)}
+	} else {
+		a = fn.fn.arity()
+	}
+	if fn.arity >= a.min && (a.max == variadic || fn.arity <= a.max) {
+		return nil
+	}
+	expected := fmt.Sprintf("%d", a.min)
+	if a.max == variadic {
+		expected = fmt.Sprintf("at least %d", a.min)
+	} else if a.max != a.min {
+		expected = fmt.Sprintf("%d to %d", a.min, a.max)
+	}
+	noun := "arguments"
+	if a.max == 1 || a.max == variadic && a.min == 1 {
+		noun = "argument"
+	}
+	return newParseError(expression, fn.pos, fn.val, fmt.Sprintf("function '%s' expects %s %s, got %d", fn.val, expected, noun, fn.arity))
+}
+
+// staticType returns the types that node can evaluate to, as far as they are
+// known before the environment is: variables can hold any type.
+func staticType(node *AST) Type {
+	switch node.Kind() {
+	case NumberLit:
+		return Scalar
+	case UnaryExpr:
+		if node.token.val == "not" {
+			return Logical
+		}
+		return staticType(node.right) & Number
+	case BinaryExpr:
+		switch node.token.val {
+		case "+", "-", "*", "/", "^", "**":
+			// an operand of unknown type can hold a vector
+			if staticType(node.left) == Scalar && staticType(node.right) == Scalar {
+				return Scalar
+			}
+			return Number
+		}
+		return Logical
+	case CallExpr:
+		if node.token.fn != nil {
+			return node.token.fn.Result
+		}
+	case LetExpr:
+		return staticType(node.right)
+	}
+	return Any
+}
+
+// checkTypes reports the arguments of calls to Go functions in node whose
+// type, as far as it is known at compile time, the function does not accept.
+func (p *parser) checkTypes(node *AST) {
+	typeErrors(node, func(arg *AST, message string, expected Type) {
+		found := Token{val: p.source[arg.Pos():arg.End()], pos: arg.Pos()}
+		p.fail(found, message, expected.String())
+	})
+}
+
+// typeErrors calls report for each argument of a call to a Go function in
+// node whose static type the function does not accept.
+func typeErrors(node *AST, report func(arg *AST, message string, expected Type)) {
+	Inspect(node, func(n *AST) bool {
+		if n == nil || n.Kind() != CallExpr || n.token.fn == nil {
+			return true
+		}
+		fn := n.token.fn
+		for i, arg := range n.args {
+			if t := staticType(arg); t&fn.param(i) == 0 {
+				report(arg, fmt.Sprintf("function '%s' expects %s for argument %d, got %s", n.token.val, fn.param(i), i+1, t), fn.param(i))
+			}
+		}
+		return true
+	})
+}
+
+// callFunction applies fn to evaluated arguments, after checking their
+// types. ParseExpr has already checked that len(args) matches the function
+// arity.
+func callFunction(fn *Func, args []interface{}) interface{} {
+	for i, arg := range args {
+		if typeOf(arg)&fn.param(i) == 0 {
+			panic(fmt.Sprintf("function '%s' expects %s for argument %d, got %T", fn.Name, fn.param(i), i+1, arg))
+		}
+	}
+	return fn.Call(args)
+}
@@ -0,0 +1,108 @@
+package ast
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// argSamples holds a variable of each type that a function can take.
+var argSamples = []struct {
+	typ  Type
+	name string
+}{
+	{Scalar, "S"},
+	{Scalar, "S32"},
+	{Vector, "V"},
+	{Vector, "V32"},
+	{Bool, "B"},
+	{Mask, "M"},
+}
+
+func TestBuiltinsCallable(t *testing.T) {
+	env := &Env{
+		"S":   0.5,
+		"S32": float32(0.5),
+		"V":   []float64{0.25, 0.5},
+		"V32": []float32{0.25, 0.5},
+		"B":   true,
+		"M":   []bool{true, false},
+	}
+	sample := func(typ Type, skip int) string {
+		for _, s := range argSamples {
+			if s.typ&typ != 0 {
+				if skip == 0 {
+					return s.name
+				}
+				skip--
+			}
+		}
+		return ""
+	}
+	for _, b := range builtins {
+		n := len(b.Params)
+		if b.Variadic {
+			n++
+		}
+		for _, name := range append([]string{b.Name}, b.aliases...) {
+			// every sample accepted by each argument, the others taking
+			// their first sample
+			for i := 0; i < n; i++ {
+				for skip := 0; sample(b.param(i), skip) != ""; skip++ {
+					args := make([]string, n)
+					for j := range args {
+						args[j] = sample(b.param(j), 0)
+					}
+					args[i] = sample(b.param(i), skip)
+					code := fmt.Sprintf("%s(%s)", name, strings.Join(args, ", "))
+					ast, err := ParseExpr(code)
+					require.NoError(t, err, code)
+					assert.Equal(t, b.Name, ast.Name(), code)
+					var result interface{}
+					require.NotPanics(t, func() { result = Evaluate(ast, env) }, code)
+					assert.NotZero(t, typeOf(result)&b.Result, "%s returned %T", code, result)
+				}
+			}
+		}
+	}
+}
+
+func TestBuiltinNames(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, b := range builtins {
+		for _, name := range append([]string{b.Name}, b.aliases...) {
+			assert.False(t, seen[name], "%s is registered twice", name)
+			seen[name] = true
+			assert.True(t, isName(name) && !isKeyword(name) && !isConstant(name), name)
+		}
+	}
+}
+
+func TestFunctionAliases(t *testing.T) {
+	ast, err := ParseExpr("roundToEven(maximum(X, 2.5))")
+	require.NoError(t, err)
+	assert.Equal(t, "roundtoeven(max(X, 2.5))", Format(ast))
+	assert.Equal(t, []float64{2.0, 4.0}, Evaluate(ast, &Env{"X": []float64{1.0, 4.0}}))
+}
+
+func TestStaticType(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected Type
+	}{
+		{"1 + 2 * pi", Scalar},
+		{"X + 1", Number},
+		{"-(X > 0)", 0},
+		// an operand of unknown type is not narrowed to a scalar
+		{"-(X > 0) + 1", Number},
+		{"sum(X) / 2", Scalar},
+		{"X > 1", Logical},
+	}
+	for _, test := range tests {
+		ast, err := ParseExpr(test.code)
+		require.NoError(t, err, test.code)
+		assert.Equal(t, test.expected, staticType(ast), test.code)
+	}
+}
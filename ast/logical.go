@@ -0,0 +1,143 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+)
+
+// Logical operators work on the bool and []bool masks produced by
+// comparisons. A bool operand is broadcast to the length of a []bool one.
+
+func logicalAnd(a, b interface{}) interface{} {
+	return logical(a, b, "and", func(x, y bool) bool { return x && y })
+}
+
+func logicalOr(a, b interface{}) interface{} {
+	return logical(a, b, "or", func(x, y bool) bool { return x || y })
+}
+
+func logical(a, b interface{}, op string, fn func(x, y bool) bool) interface{} {
+	switch x := a.(type) {
+	case bool:
+		switch y := b.(type) {
+		case bool:
+			return fn(x, y)
+		case []bool:
+			return logicalVec(repeatBool(x, len(y)), y, op, fn)
+		}
+	case []bool:
+		switch y := b.(type) {
+		case bool:
+			return logicalVec(x, repeatBool(y, len(x)), op, fn)
+		case []bool:
+			return logicalVec(x, y, op, fn)
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T %v %T", a, op, b))
+}
+
+func logicalVec(a, b []bool, op string, fn func(x, y bool) bool) []bool {
+	if len(a) != len(b) {
+		panic(fmt.Sprintf("invalid operation: mismatched lengths %d %v %d", len(a), op, len(b)))
+	}
+	out := make([]bool, len(a))
+	for j := range a {
+		out[j] = fn(a[j], b[j])
+	}
+	return out
+}
+
+func logicalNot(a interface{}) interface{} {
+	switch x := a.(type) {
+	case bool:
+		return !x
+	case []bool:
+		out := make([]bool, len(x))
+		for j := range x {
+			out[j] = !x[j]
+		}
+		return out
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "not", a))
+}
+
+func repeatBool(val bool, length int) []bool {
+	out := make([]bool, length)
+	for i := range out {
+		out[i] = val
+	}
+	return out
+}
+
+func isnan(a interface{}) interface{} {
+	switch x := a.(type) {
+	case float32:
+		return math.IsNaN(float64(x))
+	case []float32:
+		out := make([]bool, len(x))
+		for j := range x {
+			out[j] = math.IsNaN(float64(x[j]))
+		}
+		return out
+	case float64:
+		return math.IsNaN(x)
+	case []float64:
+		out := make([]bool, len(x))
+		for j := range x {
+			out[j] = math.IsNaN(x[j])
+		}
+		return out
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "IsNaN", a))
+}
+
+// anyTrue, allTrue and countTrue reduce a mask to a single value.
+
+func anyTrue(a interface{}) interface{} {
+	switch x := a.(type) {
+	case bool:
+		return x
+	case []bool:
+		for j := range x {
+			if x[j] {
+				return true
+			}
+		}
+		return false
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "Any", a))
+}
+
+func allTrue(a interface{}) interface{} {
+	switch x := a.(type) {
+	case bool:
+		return x
+	case []bool:
+		for j := range x {
+			if !x[j] {
+				return false
+			}
+		}
+		return true
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "All", a))
+}
+
+func countTrue(a interface{}) interface{} {
+	switch x := a.(type) {
+	case bool:
+		if x {
+			return float64(1)
+		}
+		return float64(0)
+	case []bool:
+		out := float64(0)
+		for j := range x {
+			if x[j] {
+				out += 1
+			}
+		}
+		return out
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "Count", a))
+}
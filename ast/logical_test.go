@@ -0,0 +1,59 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestLogicalAndOr(t *testing.T) {
+	a := []bool{true, true, false, false}
+	b := []bool{true, false, true, false}
+	assert.Equal(t, []bool{true, false, false, false}, logicalAnd(a, b))
+	assert.Equal(t, []bool{true, true, true, false}, logicalOr(a, b))
+	assert.Equal(t, []bool{false, false, false, false}, logicalAnd(a, false))
+	assert.Equal(t, []bool{true, true, true, true}, logicalOr(true, b))
+	assert.Equal(t, false, logicalAnd(true, false))
+	assert.Equal(t, true, logicalOr(true, false))
+}
+
+func TestLogicalNot(t *testing.T) {
+	assert.Equal(t, false, logicalNot(true))
+	assert.Equal(t, []bool{false, true}, logicalNot([]bool{true, false}))
+}
+
+func TestLogicalWrongType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	logicalAnd(1.0, true)
+}
+
+func TestLogicalLengthMismatch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	logicalOr([]bool{true}, []bool{true, false})
+}
+
+func TestIsNaN(t *testing.T) {
+	assert.Equal(t, true, isnan(math.NaN()))
+	assert.Equal(t, false, isnan(float32(1.0)))
+	assert.Equal(t, []bool{false, true}, isnan([]float64{1.0, math.NaN()}))
+	assert.Equal(t, []bool{true, false}, isnan([]float32{float32(math.NaN()), 1.0}))
+}
+
+func TestMaskReductions(t *testing.T) {
+	mask := []bool{false, true, true}
+	assert.Equal(t, true, anyTrue(mask))
+	assert.Equal(t, false, allTrue(mask))
+	assert.Equal(t, float64(2), countTrue(mask))
+	assert.Equal(t, false, anyTrue([]bool{}))
+	assert.Equal(t, true, allTrue([]bool{}))
+	assert.Equal(t, float64(0), countTrue([]bool{}))
+	assert.Equal(t, float64(1), countTrue(true))
+}
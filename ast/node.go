@@ -0,0 +1,171 @@
+package ast
+
+import (
+	"fmt"
+)
+
+// Kind identifies the kind of an AST node.
+type Kind int
+
+const (
+	NumberLit  Kind = iota // number literal or constant, e.g. 2.5 or pi
+	Ident                  // variable, e.g. X or "cpu load"
+	UnaryExpr              // prefix operator, e.g. -X or not M
+	BinaryExpr             // infix operator, e.g. X + 1 or M and N
+	CallExpr               // function call, e.g. max(X, 0)
+	IndexExpr              // index, e.g. X[0] or X[X > 0]
+	SliceExpr              // range index, e.g. X[1:-1]
+	LetExpr                // local variable, e.g. lo = nanmin(X); X - lo
+)
+
+var kindNames = [...]string{
+	NumberLit:  "NumberLit",
+	Ident:      "Ident",
+	UnaryExpr:  "UnaryExpr",
+	BinaryExpr: "BinaryExpr",
+	CallExpr:   "CallExpr",
+	IndexExpr:  "IndexExpr",
+	SliceExpr:  "SliceExpr",
+	LetExpr:    "LetExpr",
+}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// The methods below give read-only access to the nodes of a parsed
+// expression. They must be called on non-nil nodes.
+
+// Kind returns the kind of the node.
+func (n *AST) Kind() Kind {
+	switch n.token.typ {
+	case number:
+		return NumberLit
+	case name:
+		return Ident
+	case unary:
+		return UnaryExpr
+	case function:
+		return CallExpr
+	case index:
+		return IndexExpr
+	case slice:
+		return SliceExpr
+	case let:
+		return LetExpr
+	}
+	return BinaryExpr
+}
+
+// Op returns the operator of a UnaryExpr or a BinaryExpr, e.g. "-" or
+// "and", and an empty string for other kinds.
+func (n *AST) Op() string {
+	switch n.Kind() {
+	case UnaryExpr, BinaryExpr:
+		return n.token.val
+	}
+	return ""
+}
+
+// Name returns the variable of an Ident or a LetExpr and the function of a
+// CallExpr, and an empty string for other kinds.
+func (n *AST) Name() string {
+	switch n.Kind() {
+	case Ident, LetExpr, CallExpr:
+		return n.token.val
+	}
+	return ""
+}
+
+// Quoted reports whether an Ident was written as a quoted name, which
+// refers to the environment key of the same name.
+func (n *AST) Quoted() bool {
+	return n.token.quoted
+}
+
+// Literal returns the source text of a NumberLit, e.g. "1e-3", and an empty
+// string for other kinds.
+func (n *AST) Literal() string {
+	if n.Kind() == NumberLit {
+		return n.token.val
+	}
+	return ""
+}
+
+// Value returns the value of a NumberLit, and 0 for other kinds.
+func (n *AST) Value() float64 {
+	if n.Kind() != NumberLit {
+		return 0
+	}
+	return numberValue(n.token.val)
+}
+
+// Children returns the operands of the node in source order:
+//
+//	UnaryExpr:  operand
+//	BinaryExpr: left, right
+//	CallExpr:   arguments
+//	IndexExpr:  indexed value, index
+//	SliceExpr:  indexed value, start, stop, step (nil when omitted)
+//	LetExpr:    bound value, body
+//
+// NumberLit and Ident nodes have no children.
+func (n *AST) Children() []*AST {
+	switch n.Kind() {
+	case NumberLit, Ident:
+		return nil
+	case UnaryExpr:
+		return []*AST{n.right}
+	case CallExpr:
+		return append([]*AST(nil), n.args...)
+	case SliceExpr:
+		return append([]*AST{n.left}, n.args...)
+	}
+	return []*AST{n.left, n.right}
+}
+
+// Def returns the definition of the function called by a CallExpr, or nil
+// for builtin functions and other kinds.
+func (n *AST) Def() *FuncDef {
+	return n.token.def
+}
+
+// Func returns the Go function called by a CallExpr, builtin or registered,
+// or nil for functions defined with def and other kinds.
+func (n *AST) Func() *Func {
+	return n.token.fn
+}
+
+// Pos returns the byte offset in the source of the first character of the
+// node, including the parentheses around it.
+func (n *AST) Pos() int {
+	if n.parens != nil {
+		return n.parens.pos
+	}
+	switch n.Kind() {
+	case BinaryExpr, IndexExpr, SliceExpr:
+		return n.left.Pos()
+	}
+	return n.token.pos
+}
+
+// End returns the byte offset in the source just after the node.
+func (n *AST) End() int {
+	if n.parens != nil {
+		return n.parens.end
+	}
+	switch n.Kind() {
+	case UnaryExpr, BinaryExpr, LetExpr:
+		return n.right.End()
+	}
+	return n.token.end
+}
+
+// Body returns the expression computed by the function, in which the
+// parameters are Ident nodes.
+func (d *FuncDef) Body() *AST {
+	return d.body
+}
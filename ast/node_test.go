@@ -0,0 +1,94 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNodeAccessors(t *testing.T) {
+	code := `lo = nanmin(X); -(X - lo)[1:] * "cpu load" + 1e-3`
+	root, err := ParseExpr(code)
+	require.NoError(t, err)
+
+	assert.Equal(t, LetExpr, root.Kind())
+	assert.Equal(t, "lo", root.Name())
+	value, body := root.Children()[0], root.Children()[1]
+	assert.Equal(t, CallExpr, value.Kind())
+	assert.Equal(t, "nanmin", value.Name())
+	assert.Nil(t, value.Def())
+	assert.Equal(t, Ident, value.Children()[0].Kind())
+
+	assert.Equal(t, BinaryExpr, body.Kind())
+	assert.Equal(t, "+", body.Op())
+	lit := body.Children()[1]
+	assert.Equal(t, NumberLit, lit.Kind())
+	assert.Equal(t, "1e-3", lit.Literal())
+	assert.Equal(t, 0.001, lit.Value())
+	assert.Empty(t, lit.Children())
+
+	mul := body.Children()[0]
+	quoted := mul.Children()[1]
+	assert.Equal(t, "cpu load", quoted.Name())
+	assert.True(t, quoted.Quoted())
+
+	neg := mul.Children()[0]
+	assert.Equal(t, UnaryExpr, neg.Kind())
+	assert.Equal(t, "-", neg.Op())
+	assert.Equal(t, "", neg.Name())
+	sl := neg.Children()[0]
+	assert.Equal(t, SliceExpr, sl.Kind())
+	children := sl.Children()
+	require.Len(t, children, 4)
+	assert.Equal(t, BinaryExpr, children[0].Kind())
+	assert.Equal(t, "1", children[1].Literal())
+	assert.Nil(t, children[2])
+	assert.Nil(t, children[3])
+}
+
+func TestNodeSpan(t *testing.T) {
+	code := `lo = nanmin(X); -(X - lo)[1:] * "cpu load" + max(X, 2)[0]`
+	root, err := ParseExpr(code)
+	require.NoError(t, err)
+	var spans []string
+	Inspect(root, func(n *AST) bool {
+		if n != nil {
+			spans = append(spans, n.Kind().String()+" "+code[n.Pos():n.End()])
+		}
+		return true
+	})
+	assert.Equal(t, []string{
+		`LetExpr lo = nanmin(X); -(X - lo)[1:] * "cpu load" + max(X, 2)[0]`,
+		`CallExpr nanmin(X)`,
+		`Ident X`,
+		`BinaryExpr -(X - lo)[1:] * "cpu load" + max(X, 2)[0]`,
+		`BinaryExpr -(X - lo)[1:] * "cpu load"`,
+		`UnaryExpr -(X - lo)[1:]`,
+		`SliceExpr (X - lo)[1:]`,
+		`BinaryExpr (X - lo)`,
+		`Ident X`,
+		`Ident lo`,
+		`NumberLit 1`,
+		`Ident "cpu load"`,
+		`IndexExpr max(X, 2)[0]`,
+		`CallExpr max(X, 2)`,
+		`Ident X`,
+		`NumberLit 2`,
+		`NumberLit 0`,
+	}, spans)
+}
+
+func TestNodeDef(t *testing.T) {
+	root, err := ParseExpr("def sq(v) = v * v; sq(X)")
+	require.NoError(t, err)
+	def := root.Def()
+	require.NotNil(t, def)
+	assert.Equal(t, "sq", def.Name)
+	assert.Equal(t, BinaryExpr, def.Body().Kind())
+	assert.Equal(t, "v", def.Body().Children()[0].Name())
+}
+
+func TestKindString(t *testing.T) {
+	assert.Equal(t, "SliceExpr", SliceExpr.String())
+	assert.Equal(t, "Kind(42)", Kind(42).String())
+}
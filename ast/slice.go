@@ -0,0 +1,239 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+)
+
+// sliceBounds holds the evaluated start, stop and step of a range index
+// such as X[2:10:2]. Nil fields were omitted in the source and take their
+// Python defaults.
+type sliceBounds struct {
+	start *int
+	stop  *int
+	step  *int
+}
+
+// newSliceBounds converts evaluated bound expressions, nil when omitted, to
+// sliceBounds.
+func newSliceBounds(start, stop, step interface{}) *sliceBounds {
+	bound := func(v interface{}) *int {
+		if v == nil {
+			return nil
+		}
+		i := toIndex(v)
+		return &i
+	}
+	b := &sliceBounds{start: bound(start), stop: bound(stop), step: bound(step)}
+	if b.step != nil && *b.step == 0 {
+		panic("Invalid slice: step cannot be zero")
+	}
+	return b
+}
+
+// indices resolves the bounds against a vector of the given length, with the
+// same clamping rules as Python's slice.indices.
+func (b *sliceBounds) indices(length int) (start, stop, step int) {
+	step = 1
+	if b.step != nil {
+		step = *b.step
+	}
+	lower, upper := 0, length
+	if step < 0 {
+		lower, upper = -1, length-1
+	}
+	resolve := func(v *int, def int) int {
+		if v == nil {
+			return def
+		}
+		i := *v
+		if i < 0 {
+			i += length
+		}
+		if i < lower {
+			return lower
+		}
+		if i > upper {
+			return upper
+		}
+		return i
+	}
+	if step < 0 {
+		return resolve(b.start, upper), resolve(b.stop, lower), step
+	}
+	return resolve(b.start, lower), resolve(b.stop, upper), step
+}
+
+// toIndex converts an evaluated index to an int. Indexes are numbers in
+// expressions, so any float with an integral value is accepted.
+func toIndex(v interface{}) int {
+	var f float64
+	switch x := v.(type) {
+	case int:
+		return x
+	case float32:
+		f = float64(x)
+	case float64:
+		f = x
+	default:
+		panic(fmt.Sprintf("Invalid index type '%T'", v))
+	}
+	if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		panic(fmt.Sprintf("Invalid index %v: not an integer", f))
+	}
+	return int(f)
+}
+
+// elementIndex resolves a possibly negative index against a vector of the
+// given length.
+func elementIndex(label string, idx, length int) int {
+	i := idx
+	if i < 0 {
+		i += length
+	}
+	if i < 0 || i >= length {
+		panic(fmt.Sprintf("Index %d out of range for %s of length %d", idx, label, length))
+	}
+	return i
+}
+
+// indexLabel describes the indexed value of node in error messages.
+func indexLabel(node *AST) string {
+	if node != nil && node.token.typ == name {
+		return fmt.Sprintf("'%s'", node.token.val)
+	}
+	return "vector"
+}
+
+// indexVec selects elements of a. A scalar idx returns a single element, a
+// []bool mask of the same length as a returns the elements where the mask is
+// true, and a vector of integers returns the elements at those positions.
+func indexVec(a, idx interface{}, label string) interface{} {
+	switch x := a.(type) {
+	case []float32:
+		switch i := idx.(type) {
+		case []bool:
+			return maskFloat32(x, i, label)
+		case []int, []float32, []float64:
+			return gatherFloat32(x, indexes(i), label)
+		}
+		return x[elementIndex(label, toIndex(idx), len(x))]
+	case []float64:
+		switch i := idx.(type) {
+		case []bool:
+			return maskFloat64(x, i, label)
+		case []int, []float32, []float64:
+			return gatherFloat64(x, indexes(i), label)
+		}
+		return x[elementIndex(label, toIndex(idx), len(x))]
+	}
+	panic(fmt.Sprintf("Unsupported data type '%T' for index of %s", a, label))
+}
+
+// indexes converts a vector of integer indexes to []int.
+func indexes(idx interface{}) []int {
+	switch x := idx.(type) {
+	case []int:
+		return x
+	case []float32:
+		out := make([]int, len(x))
+		for j := range x {
+			out[j] = toIndex(x[j])
+		}
+		return out
+	case []float64:
+		out := make([]int, len(x))
+		for j := range x {
+			out[j] = toIndex(x[j])
+		}
+		return out
+	}
+	panic(fmt.Sprintf("Invalid index type '%T'", idx))
+}
+
+func checkMask(mask []bool, length int, label string) {
+	if len(mask) != length {
+		panic(fmt.Sprintf("Mask of length %d does not match %s of length %d", len(mask), label, length))
+	}
+}
+
+func maskFloat32(a []float32, mask []bool, label string) []float32 {
+	checkMask(mask, len(a), label)
+	out := make([]float32, 0)
+	for j := range a {
+		if mask[j] {
+			out = append(out, a[j])
+		}
+	}
+	return out
+}
+
+func maskFloat64(a []float64, mask []bool, label string) []float64 {
+	checkMask(mask, len(a), label)
+	out := make([]float64, 0)
+	for j := range a {
+		if mask[j] {
+			out = append(out, a[j])
+		}
+	}
+	return out
+}
+
+func gatherFloat32(a []float32, idx []int, label string) []float32 {
+	out := make([]float32, len(idx))
+	for j, i := range idx {
+		out[j] = a[elementIndex(label, i, len(a))]
+	}
+	return out
+}
+
+func gatherFloat64(a []float64, idx []int, label string) []float64 {
+	out := make([]float64, len(idx))
+	for j, i := range idx {
+		out[j] = a[elementIndex(label, i, len(a))]
+	}
+	return out
+}
+
+func sliceVec(a interface{}, b *sliceBounds, label string) interface{} {
+	switch x := a.(type) {
+	case []float32:
+		return sliceFloat32(x, b)
+	case []float64:
+		return sliceFloat64(x, b)
+	}
+	panic(fmt.Sprintf("Unsupported data type '%T' for slice of %s", a, label))
+}
+
+// sliceFloat32 and sliceFloat64 return a view of a when the step is 1 and a
+// copy of the selected elements otherwise.
+
+func sliceFloat32(a []float32, b *sliceBounds) []float32 {
+	start, stop, step := b.indices(len(a))
+	if step == 1 {
+		if stop < start {
+			stop = start
+		}
+		return a[start:stop:stop]
+	}
+	out := make([]float32, 0)
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		out = append(out, a[i])
+	}
+	return out
+}
+
+func sliceFloat64(a []float64, b *sliceBounds) []float64 {
+	start, stop, step := b.indices(len(a))
+	if step == 1 {
+		if stop < start {
+			stop = start
+		}
+		return a[start:stop:stop]
+	}
+	out := make([]float64, 0)
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		out = append(out, a[i])
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSliceFloat64(t *testing.T) {
+	X := []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	tests := []struct {
+		start, stop, step interface{}
+		expected          []float64
+	}{
+		{2.0, 5.0, nil, []float64{2, 3, 4}},
+		{nil, nil, 3.0, []float64{0, 3, 6, 9}},
+		{-3.0, nil, nil, []float64{9, 10, 11}},
+		{nil, -9.0, nil, []float64{0, 1, 2}},
+		{nil, nil, -4.0, []float64{11, 7, 3}},
+		{5.0, 2.0, -1.0, []float64{5, 4, 3}},
+		{8.0, 2.0, nil, []float64{}},
+		{-100.0, 2.0, nil, []float64{0, 1}},
+		{10.0, 100.0, nil, []float64{10, 11}},
+		{float32(1.0), float32(3.0), float32(1.0), []float64{1, 2}},
+	}
+	for _, test := range tests {
+		bounds := newSliceBounds(test.start, test.stop, test.step)
+		assert.Equal(t, test.expected, sliceFloat64(X, bounds), "%v:%v:%v", test.start, test.stop, test.step)
+	}
+}
+
+func TestSliceFloat32View(t *testing.T) {
+	X := []float32{0, 1, 2, 3}
+	out := sliceFloat32(X, newSliceBounds(1.0, 3.0, nil))
+	assert.Equal(t, []float32{1, 2}, out)
+	assert.Equal(t, 2, cap(out))
+	X[1] = 10
+	assert.Equal(t, float32(10), out[0])
+}
+
+func TestSliceInvalidBounds(t *testing.T) {
+	assert.PanicsWithValue(t, "Invalid slice: step cannot be zero", func() { newSliceBounds(nil, nil, 0.0) })
+	assert.PanicsWithValue(t, "Invalid index 1.5: not an integer", func() { newSliceBounds(1.5, nil, nil) })
+	assert.PanicsWithValue(t, "Invalid index type '[]float64'", func() { newSliceBounds([]float64{1.0}, nil, nil) })
+}
+
+func TestElementIndexOutOfRange(t *testing.T) {
+	assert.Equal(t, 2, elementIndex("'X'", -1, 3))
+	assert.PanicsWithValue(t, "Index 3 out of range for 'X' of length 3", func() { elementIndex("'X'", 3, 3) })
+	assert.PanicsWithValue(t, "Index -4 out of range for 'X' of length 3", func() { elementIndex("'X'", -4, 3) })
+}
+
+func TestIndexVecMask(t *testing.T) {
+	X := []float64{-1.0, 2.0, -3.0, 4.0}
+	assert.Equal(t, []float64{2.0, 4.0}, indexVec(X, []bool{false, true, false, true}, "'X'"))
+	assert.Equal(t, []float32{}, indexVec([]float32{1.0}, []bool{false}, "'Y'"))
+	assert.PanicsWithValue(t, "Mask of length 2 does not match 'X' of length 4", func() { indexVec(X, []bool{true, false}, "'X'") })
+}
+
+func TestIndexVecGather(t *testing.T) {
+	X := []float32{-1.0, 2.0, -3.0, 4.0}
+	assert.Equal(t, []float32{-1.0, 4.0, 4.0}, indexVec(X, []int{0, 3, -1}, "'X'"))
+	assert.Equal(t, []float32{-3.0, 2.0}, indexVec(X, []float64{2.0, 1.0}, "'X'"))
+	assert.Equal(t, []float32{2.0}, indexVec(X, []float32{1.0}, "'X'"))
+	assert.Equal(t, float32(2.0), indexVec(X, 1, "'X'"))
+	assert.PanicsWithValue(t, "Index 4 out of range for 'X' of length 4", func() { indexVec(X, []int{0, 4}, "'X'") })
+	assert.PanicsWithValue(t, "Invalid index 0.5: not an integer", func() { indexVec(X, []float64{0.5}, "'X'") })
+}
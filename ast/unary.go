@@ -0,0 +1,43 @@
+package ast
+
+import (
+	"fmt"
+)
+
+func negate(a interface{}) interface{} {
+	switch x := a.(type) {
+	case float32:
+		return -x
+	case []float32:
+		return negateFloat32(x)
+	case float64:
+		return -x
+	case []float64:
+		return negateFloat64(x)
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "-", a))
+}
+
+func negateFloat32(a []float32) interface{} {
+	out := make([]float32, len(a))
+	for j := range a {
+		out[j] = -a[j]
+	}
+	return out
+}
+
+func negateFloat64(a []float64) interface{} {
+	out := make([]float64, len(a))
+	for j := range a {
+		out[j] = -a[j]
+	}
+	return out
+}
+
+func identity(a interface{}) interface{} {
+	switch a.(type) {
+	case float32, []float32, float64, []float64:
+		return a
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "+", a))
+}
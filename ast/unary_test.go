@@ -0,0 +1,22 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegate(t *testing.T) {
+	assert.Equal(t, float64(-1.0), negate(float64(1.0)))
+	assert.Equal(t, float32(-1.0), negate(float32(1.0)))
+	assert.Equal(t, []float64{-1.0, 2.0}, negate([]float64{1.0, -2.0}))
+	assert.Equal(t, []float32{-1.0, 2.0}, negate([]float32{1.0, -2.0}))
+}
+
+func TestNegateWrongType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	negate("foo")
+}
@@ -0,0 +1,44 @@
+package ast
+
+// A Visitor's Visit method is invoked for each node encountered by Walk. If
+// the result visitor w is not nil, Walk visits each of the children of node
+// with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node *AST) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: it starts by calling
+// v.Visit(node); node must not be nil. If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor w for
+// each of the non-nil children of node, followed by a call of w.Visit(nil).
+//
+// Walk does not enter the bodies of the functions called; they can be
+// reached with Def.
+func Walk(v Visitor, node *AST) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, child := range node.Children() {
+		if child != nil {
+			Walk(v, child)
+		}
+	}
+	v.Visit(nil)
+}
+
+type inspector func(*AST) bool
+
+func (f inspector) Visit(node *AST) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: it starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a call
+// of f(nil).
+func Inspect(node *AST, f func(*AST) bool) {
+	Walk(inspector(f), node)
+}
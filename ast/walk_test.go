@@ -0,0 +1,71 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// depthVisitor records each node with its depth, and the end of each list
+// of children.
+type depthVisitor struct {
+	depth int
+	log   *[]string
+}
+
+func (v depthVisitor) Visit(node *AST) Visitor {
+	if node == nil {
+		*v.log = append(*v.log, "end")
+		return nil
+	}
+	*v.log = append(*v.log, string(rune('0'+v.depth))+" "+node.Kind().String())
+	return depthVisitor{depth: v.depth + 1, log: v.log}
+}
+
+func TestWalk(t *testing.T) {
+	root, err := ParseExpr("max(X[::2], -1)")
+	require.NoError(t, err)
+	var log []string
+	Walk(depthVisitor{log: &log}, root)
+	assert.Equal(t, []string{
+		"0 CallExpr",
+		"1 SliceExpr",
+		"2 Ident",
+		"end",
+		"2 NumberLit",
+		"end",
+		"end",
+		"1 UnaryExpr",
+		"2 NumberLit",
+		"end",
+		"end",
+		"end",
+	}, log)
+}
+
+func TestInspectVariables(t *testing.T) {
+	root, err := ParseExpr(`lo = nanmin(X); where(X > lo, host.cpu, "cpu load")[0:n]`)
+	require.NoError(t, err)
+	var names []string
+	Inspect(root, func(n *AST) bool {
+		if n != nil && n.Kind() == Ident {
+			names = append(names, n.Name())
+		}
+		return true
+	})
+	assert.Equal(t, []string{"X", "X", "lo", "host.cpu", "cpu load", "n"}, names)
+}
+
+func TestInspectPrune(t *testing.T) {
+	root, err := ParseExpr("add(sum(X), Y) * Z")
+	require.NoError(t, err)
+	var visited []string
+	Inspect(root, func(n *AST) bool {
+		if n == nil {
+			return false
+		}
+		visited = append(visited, n.Kind().String())
+		return n.Kind() != CallExpr
+	})
+	assert.Equal(t, []string{"BinaryExpr", "CallExpr", "Ident"}, visited)
+}
@@ -0,0 +1,117 @@
+package ast
+
+import (
+	"fmt"
+)
+
+// where selects elements from a where cond is true and from b elsewhere.
+// Each of the three arguments may be a scalar or a vector; scalars are
+// broadcast, and all vector arguments must have the same length. The result
+// is float32 if both a and b are float32 values, float64 otherwise.
+func where(cond, a, b interface{}) interface{} {
+	if !isMask(cond) || !isNumeric(a) || !isNumeric(b) {
+		panic(fmt.Sprintf("invalid operation: %v %T %T %T", "where", cond, a, b))
+	}
+	length := -1
+	for _, arg := range []interface{}{cond, a, b} {
+		n := -1
+		switch x := arg.(type) {
+		case []bool:
+			n = len(x)
+		case []float32:
+			n = len(x)
+		case []float64:
+			n = len(x)
+		}
+		if n == -1 {
+			continue
+		}
+		if length != -1 && n != length {
+			panic(fmt.Sprintf("invalid operation: %v mismatched lengths %d and %d", "where", length, n))
+		}
+		length = n
+	}
+	if length == -1 {
+		if cond.(bool) {
+			return a
+		}
+		return b
+	}
+
+	mask, ok := cond.([]bool)
+	if !ok {
+		mask = repeatBool(cond.(bool), length)
+	}
+	if isFloat32(a) && isFloat32(b) {
+		x := broadcastFloat32(a, length)
+		y := broadcastFloat32(b, length)
+		out := make([]float32, length)
+		for j := range out {
+			if mask[j] {
+				out[j] = x[j]
+			} else {
+				out[j] = y[j]
+			}
+		}
+		return out
+	}
+	x := broadcastFloat64(a, length)
+	y := broadcastFloat64(b, length)
+	out := make([]float64, length)
+	for j := range out {
+		if mask[j] {
+			out[j] = x[j]
+		} else {
+			out[j] = y[j]
+		}
+	}
+	return out
+}
+
+func isMask(v interface{}) bool {
+	switch v.(type) {
+	case bool, []bool:
+		return true
+	}
+	return false
+}
+
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case float32, []float32, float64, []float64:
+		return true
+	}
+	return false
+}
+
+func isFloat32(v interface{}) bool {
+	switch v.(type) {
+	case float32, []float32:
+		return true
+	}
+	return false
+}
+
+func broadcastFloat32(v interface{}, length int) []float32 {
+	switch x := v.(type) {
+	case float32:
+		return repeatFloat32(x, length)
+	case []float32:
+		return x
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "broadcast float32", v))
+}
+
+func broadcastFloat64(v interface{}, length int) []float64 {
+	switch x := v.(type) {
+	case float32:
+		return repeatFloat64(float64(x), length)
+	case []float32:
+		return castFloat64(x)
+	case float64:
+		return repeatFloat64(x, length)
+	case []float64:
+		return x
+	}
+	panic(fmt.Sprintf("invalid operation: %v %T", "broadcast float64", v))
+}
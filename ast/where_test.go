@@ -0,0 +1,38 @@
+package ast
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWhereScalars(t *testing.T) {
+	assert.Equal(t, 1.0, where(true, 1.0, 2.0))
+	assert.Equal(t, float32(2.0), where(false, 1.0, float32(2.0)))
+}
+
+func TestWhereBroadcast(t *testing.T) {
+	mask := []bool{true, false, true}
+	assert.Equal(t, []float64{1.0, 0.0, 3.0}, where(mask, []float64{1.0, 2.0, 3.0}, 0.0))
+	assert.Equal(t, []float64{0.0, 2.0, 0.0}, where(mask, float32(0.0), []float64{1.0, 2.0, 3.0}))
+	assert.Equal(t, []float32{1.0, -1.0, 1.0}, where(mask, float32(1.0), float32(-1.0)))
+	assert.Equal(t, []float64{1.0, 2.0, 3.0}, where(true, []float32{1.0, 2.0, 3.0}, []float64{4.0, 5.0, 6.0}))
+	assert.Equal(t, []float32{4.0, 5.0}, where(false, []float32{1.0, 2.0}, []float32{4.0, 5.0}))
+}
+
+func TestWhereLengthMismatch(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	where([]bool{true, false}, []float64{1.0, 2.0, 3.0}, 0.0)
+}
+
+func TestWhereWrongType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	where(1.0, 1.0, 2.0)
+}
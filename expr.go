@@ -18,35 +18,59 @@ func (e *EvaluateError) Error() string {
 // The input expression is parsed into an AST (Abstract Syntax Tree) node, which
 // is then returned along with any errors that occurred during the parsing process.
 //
+// The expression can also call funcs, in addition to the functions
+// registered with Function.
+//
 // Parameters:
 //   - input (string): The input expression to be compiled.
+//   - funcs (...*ast.Func): The functions the expression can call.
 //
 // Returns:
 //   - node (*ast.AST): The root node of the compiled AST.
 //   - err (error): Any error that occurred during parsing, or nil if no errors occurred.
 //
-// If a panic occurs during parsing, it is caught and an error is returned with a message describing the cause of the panic.
-// If the panic is not a string or an error, an "unknown panic" error is returned.
+// Parsing never panics: any input either compiles or returns an *ast.ParseError
+// describing the syntax error. An invalid function in funcs, such as one
+// without an implementation, returns a plain error instead.
 //
 // Example usage:
 //
 // node, err := ast.Compile("1 + 2 * 3")
-func Compile(input string) (node *ast.AST, err error) {
-	node = nil
-	defer func() {
-		if r := recover(); r != nil {
-			switch x := r.(type) {
-			case string:
-				err = errors.New(x)
-			case error:
-				err = x
-			default:
-				err = errors.New("unknown panic")
-			}
-		}
-	}()
-	node, err = ast.ParseExpr(input)
-	return node, err
+func Compile(input string, funcs ...*ast.Func) (node *ast.AST, err error) {
+	return ast.ParseExprFuncs(input, 0, funcs...)
+}
+
+// Define parses a function definition and makes the function callable from
+// the expressions compiled afterwards.
+//
+// Example usage:
+//
+// err := expr.Define("def zscore(v) = (v - nanmean(v)) / nanstd(v)")
+func Define(source string) error {
+	def, err := ast.ParseDef(source)
+	if err != nil {
+		return err
+	}
+	ast.Define(def)
+	return nil
+}
+
+// Function makes the Go function impl callable as name from the expressions
+// compiled afterwards, like a builtin: the number and types of the arguments
+// of each call are checked at compile time, and a function of float64
+// arguments is applied element-wise to vectors. The optional signature
+// narrows the types each parameter accepts. See ast.NewFunc for the Go
+// functions accepted.
+//
+// Example usage:
+//
+// err := expr.Function("clamp", func(x, lo, hi float64) float64 { return math.Max(lo, math.Min(x, hi)) })
+func Function(name string, impl interface{}, signature ...ast.Type) error {
+	fn, err := ast.NewFunc(name, impl, signature...)
+	if err != nil {
+		return err
+	}
+	return ast.RegisterFunc(fn)
 }
 
 // Run executes the given AST in the provided environment.
@@ -68,7 +68,7 @@ func TestEvaluateRecover(t *testing.T) {
 
 func TestEvaluateMissingOperand(t *testing.T) {
 	_, err := expr.Evaluate("aa * ", nil)
-	expected := &expr.EvaluateError{Message: "runtime error: index out of range [-1]"}
+	expected := &ast.ParseError{Offset: 3, Message: "missing operand"}
 	if err == nil {
 		t.Error("Expected error but got nil")
 	}
@@ -77,6 +77,79 @@ func TestEvaluateMissingOperand(t *testing.T) {
 	}
 }
 
+func TestEvaluateIndexOutOfRange(t *testing.T) {
+	env := &ast.Env{
+		"X": []float64{1.0, 2.0, 3.0},
+	}
+	_, err := expr.Evaluate("X[-4]", env)
+	expected := &expr.EvaluateError{Message: "Index -4 out of range for 'X' of length 3"}
+	require.Error(t, err)
+	require.Equal(t, expected.Error(), err.Error())
+}
+
+func TestEvaluateMaskLengthMismatch(t *testing.T) {
+	env := &ast.Env{
+		"X": []float64{1.0, 2.0, 3.0},
+		"Y": []float64{1.0, 2.0},
+	}
+	_, err := expr.Evaluate("X[Y > 1]", env)
+	expected := &expr.EvaluateError{Message: "Mask of length 2 does not match 'X' of length 3"}
+	require.Error(t, err)
+	require.Equal(t, expected.Error(), err.Error())
+}
+
+func TestDefine(t *testing.T) {
+	require.NoError(t, expr.Define("def testzscore(v) = (v - nanmean(v)) / nanstd(v)"))
+	defer ast.Undefine("testzscore")
+	env := &ast.Env{
+		"X": []float64{1.0, 2.0, 3.0},
+	}
+	out, err := expr.Evaluate("testzscore(X)", env)
+	require.NoError(t, err)
+	require.Equal(t, []float64{-1.0, 0.0, 1.0}, out)
+
+	err = expr.Define("def testbad(v) = testbad(v)")
+	require.EqualError(t, err, "function 'testbad' cannot call itself at position 17")
+}
+
+func TestFunction(t *testing.T) {
+	clamp := func(x, lo, hi float64) float64 { return math.Max(lo, math.Min(x, hi)) }
+	require.NoError(t, expr.Function("testclamp", clamp))
+	defer ast.UnregisterFunc("testclamp")
+	env := &ast.Env{
+		"X": []float64{-2.0, 0.5, 2.0},
+	}
+	out, err := expr.Evaluate("testclamp(X, -1, 1)", env)
+	require.NoError(t, err)
+	require.Equal(t, []float64{-1.0, 0.5, 1.0}, out)
+
+	_, err = expr.Compile("testclamp(X, 1)")
+	require.EqualError(t, err, "function 'testclamp' expects 3 arguments, got 2 at position 0")
+	_, err = expr.Compile("testclamp(X > 0, 0, 1)")
+	require.EqualError(t, err, "function 'testclamp' expects scalar or vector for argument 1, got bool or mask at position 10")
+
+	// the name is still read as a variable when it is not called
+	out, err = expr.Evaluate("testclamp + 1", &ast.Env{"testclamp": 2.0})
+	require.NoError(t, err)
+	require.Equal(t, 3.0, out)
+
+	err = expr.Function("sqrt", math.Sqrt)
+	require.EqualError(t, err, "cannot redefine builtin function 'sqrt'")
+}
+
+func TestCompileFunctions(t *testing.T) {
+	last, err := ast.NewFunc("last", func(v []float64) float64 { return v[len(v)-1] })
+	require.NoError(t, err)
+	program, err := expr.Compile("last(X) * 2", last)
+	require.NoError(t, err)
+	out, err := expr.Run(program, &ast.Env{"X": []float64{1.0, 2.0}})
+	require.NoError(t, err)
+	require.Equal(t, 4.0, out)
+
+	_, err = expr.Compile("last(X) * 2")
+	require.EqualError(t, err, "unknown function 'last' at position 0")
+}
+
 func TestEvaluateCos(t *testing.T) {
 	code := `2 * cos(Features)`
 	program, err := expr.Compile(code)